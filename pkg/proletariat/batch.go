@@ -0,0 +1,49 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import "time"
+
+const (
+	defaultBatchLinger = time.Millisecond
+
+	// Maximum time spent writing the pending batch when closing.
+	batchCloseTimeout = time.Second
+)
+
+// BatchPolicy defines how messages written to the same connection
+// are gathered and flushed together. Only messages are batched, any
+// other frame flushes the pending batch immediately. Messages in a
+// batch that fails to flush are lost and the connection is closed.
+type BatchPolicy struct {
+	// Maximum bytes gathered before flushing.
+	// Zero disables batching, flushing every message when written.
+	MaxSize int
+
+	// Maximum time a message waits to be flushed.
+	// Zero means a default of 1 millisecond.
+	Linger time.Duration
+}
+
+func (b BatchPolicy) enabled() bool {
+	return b.MaxSize > 0
+}
+
+func (b BatchPolicy) linger() time.Duration {
+	if b.Linger <= 0 {
+		return defaultBatchLinger
+	}
+	return b.Linger
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	// Buffers bigger than this are not returned to the pool, so
+	// a single big message does not hold memory forever.
+	maxPooledBufferSize = 64 << 10
+)
+
+// Pool of buffers used to receive frames.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// Retrieve an empty buffer that can hold the given size without allocating.
+func acquireBuffer(size int) *bytes.Buffer {
+	buffer := buffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	buffer.Grow(size)
+	return buffer
+}
+
+// Return the buffer to the pool, to be reused.
+func releaseBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	buffers.Put(buffer)
+}
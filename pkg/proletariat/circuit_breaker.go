@@ -0,0 +1,200 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 5 * time.Second
+)
+
+// CircuitBreakerPolicy defines when sending to a peer stops being tried.
+// After the threshold of consecutive failures the circuit opens, and
+// sending to the peer fails immediately with a CircuitOpenError. After
+// the probe interval a single message is sent as a probe: if it
+// succeeds the circuit closes, otherwise it opens again.
+type CircuitBreakerPolicy struct {
+	// Consecutive failures to open the circuit.
+	// Zero disables the circuit breaker.
+	FailureThreshold int
+
+	// Time the circuit stays open before probing the peer.
+	// Zero means a default of 5 seconds.
+	ProbeInterval time.Duration
+}
+
+func (c CircuitBreakerPolicy) probeInterval() time.Duration {
+	if c.ProbeInterval <= 0 {
+		return defaultProbeInterval
+	}
+	return c.ProbeInterval
+}
+
+// CircuitState is the state of the circuit to a peer.
+type CircuitState uint8
+
+const (
+	// CircuitClosed sends messages normally.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen rejects messages without trying to send.
+	CircuitOpen
+
+	// CircuitHalfOpen is sending a probe, rejecting other messages.
+	CircuitHalfOpen
+)
+
+// String implements the fmt.Stringer interface.
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitOpenError is returned when sending to a peer with the circuit
+// open, so the message was not sent. Callers can detect it using
+// errors.As to route around the peer.
+type CircuitOpenError struct {
+	// Address of the peer.
+	Address Address
+
+	// State of the circuit when the message was rejected.
+	State CircuitState
+
+	// When the peer will be probed again.
+	RetryAt time.Time
+}
+
+// Error implements the error interface.
+func (c *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit to %s is %s", c.Address, c.State)
+}
+
+// The circuit to a single peer.
+type circuit struct {
+	state CircuitState
+
+	// Consecutive failures while closed.
+	failures int
+
+	// When the circuit opened.
+	openedAt time.Time
+}
+
+// Circuit breakers for every peer that failed.
+type circuitBreakers struct {
+	// Synchronize the circuits.
+	mutex *sync.Mutex
+
+	// When circuits open and close.
+	policy CircuitBreakerPolicy
+
+	// Source of the current time.
+	clock Clock
+
+	// Circuits by the peer address, peers without failures are not present.
+	circuits map[Address]*circuit
+}
+
+func newCircuitBreakers(policy CircuitBreakerPolicy, clock Clock) *circuitBreakers {
+	return &circuitBreakers{
+		mutex:    &sync.Mutex{},
+		policy:   policy,
+		clock:    clock,
+		circuits: make(map[Address]*circuit),
+	}
+}
+
+// Verify if a message can be sent to the peer, returning a
+// CircuitOpenError if not. The result of sending must be recorded.
+func (c *circuitBreakers) allow(address Address) error {
+	if c.policy.FailureThreshold <= 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, ok := c.circuits[address]
+	if !ok || current.state == CircuitClosed {
+		return nil
+	}
+
+	retryAt := current.openedAt.Add(c.policy.probeInterval())
+	if current.state == CircuitOpen && !c.clock.Now().Before(retryAt) {
+		current.state = CircuitHalfOpen
+		return nil
+	}
+	return &CircuitOpenError{Address: address, State: current.state, RetryAt: retryAt}
+}
+
+// Record the result of sending to the peer. Only failures of the
+// transport count, errors caused by the frame or by the peer being busy
+// do not say anything about the health of the connection.
+func (c *circuitBreakers) record(address Address, err error) {
+	if c.policy.FailureThreshold <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, ok := c.circuits[address]
+	if err == nil {
+		delete(c.circuits, address)
+		return
+	}
+
+	if !isTransportFailure(err) {
+		// The probe did not reach the peer, so another is allowed.
+		if ok && current.state == CircuitHalfOpen {
+			current.state = CircuitOpen
+		}
+		return
+	}
+
+	if !ok {
+		current = &circuit{}
+		c.circuits[address] = current
+	}
+
+	current.failures++
+	if current.state == CircuitHalfOpen || current.failures >= c.policy.FailureThreshold {
+		current.state = CircuitOpen
+		current.openedAt = c.clock.Now()
+	}
+}
+
+// Verify if the error is a failure dialing or writing to the peer.
+// Frames too large are refused before writing anything, the receiver
+// being busy is flow control, a peer in backoff already failed, and
+// the context of the caller is done before writing.
+func isTransportFailure(err error) bool {
+	switch err {
+	case ErrFrameTooLarge, ErrReceiverBusy, ErrPeerBackoff, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
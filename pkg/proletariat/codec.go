@@ -0,0 +1,421 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/ugorji/go/codec"
+	"io"
+	"math"
+)
+
+const (
+	// Size of the header holding the frame length.
+	lengthPrefixSize = 4
+
+	// Size of the fields at the start of the body.
+	versionSize     = 1
+	kindSize        = 1
+	idSize          = 8
+	originSize      = 8
+	sequenceSize    = 8
+	headerCountSize = 2
+	fixedBodySize   = versionSize + kindSize + idSize + originSize + sequenceSize + headerCountSize
+
+	// Size of the fields holding a header key and value length.
+	headerKeySize   = 2
+	headerValueSize = 4
+
+	// Default maximum size accepted for a single frame.
+	defaultMaxFrameSize = 64 << 20
+
+	// Version of the layout written by the LengthPrefixedCodec.
+	lengthPrefixedVersion = 1
+)
+
+// FrameKind identifies the purpose of a frame.
+type FrameKind uint8
+
+const (
+	// KindMessage is a message sent without waiting for a reply.
+	KindMessage FrameKind = iota
+
+	// KindRequest is a message waiting for a reply.
+	KindRequest
+
+	// KindReply is the response to a request, with the same identifier.
+	KindReply
+
+	// KindReliable is a message the receiver acknowledges after
+	// publishing it to be consumed.
+	KindReliable
+
+	// KindAck acknowledges the reliable message with the same identifier.
+	KindAck
+
+	// KindHello carries the identity of the peer, sent by both sides
+	// before any other frame.
+	KindHello
+
+	// KindPing is a heartbeat, answered with the same identifier.
+	KindPing
+
+	// KindPong answers the ping with the same identifier.
+	KindPong
+
+	// KindCredit returns to the peer the amount of credits in the
+	// identifier, after handling its messages.
+	KindCredit
+
+	// KindSkip tells the peer the ordered message with the same
+	// sequence was not written, so it is not waited for.
+	KindSkip
+)
+
+// Frame is the unit written to and read from a connection.
+type Frame struct {
+	// Purpose of the frame.
+	Kind FrameKind
+
+	// Identifier of the message, also used to correlate requests and
+	// replies, or reliable messages and acknowledgements.
+	ID uint64
+
+	// Random identifier of the sending instance, that together with
+	// the message identifier makes the message unique.
+	Origin uint64
+
+	// Position of the message between the ones sent by the origin to
+	// the same destination, zero when the message is not ordered.
+	Sequence uint64
+
+	// Metadata of the message.
+	Headers map[string][]byte
+
+	// Payload of the message.
+	Data []byte
+
+	// Pooled buffer holding the payload, when decoded by a codec
+	// that reuses buffers.
+	buffer *bytes.Buffer
+}
+
+// Codec defines how frames are written to and read from a connection.
+// Both peers must use the same Codec.
+type Codec interface {
+	// NewEncoder creates an Encoder writing frames to the writer.
+	NewEncoder(w io.Writer) Encoder
+
+	// NewDecoder creates a Decoder reading frames from the reader.
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder writes frames to the underlying writer.
+type Encoder interface {
+	// Encode writes the frame.
+	Encode(Frame) error
+}
+
+// Decoder reads frames from the underlying reader.
+type Decoder interface {
+	// Decode reads the next frame, blocking until it is available.
+	Decode() (Frame, error)
+}
+
+// MsgpackCodec is the default Codec.
+// Each frame is written as a msgpack array, holding the kind, the
+// identifier, the origin, the sequence, the map of headers and the
+// binary payload.
+//
+// Before frames carried these fields, each frame was only the payload
+// as msgpack binary. Frames in the previous format are still read, as
+// messages without headers, but peers using the previous format can not
+// read the frames written now, so every peer must be upgraded.
+type MsgpackCodec struct{}
+
+// The frame representation written by the MsgpackCodec.
+type msgpackFrame struct {
+	_struct bool `codec:",toarray"`
+
+	Kind     FrameKind
+	ID       uint64
+	Origin   uint64
+	Sequence uint64
+	Headers  map[string][]byte
+	Data     []byte
+}
+
+// NewEncoder implements the Codec interface.
+func (MsgpackCodec) NewEncoder(w io.Writer) Encoder {
+	return &msgpackEncoder{encoder: codec.NewEncoder(w, &codec.MsgpackHandle{})}
+}
+
+// NewDecoder implements the Codec interface.
+func (MsgpackCodec) NewDecoder(r io.Reader) Decoder {
+	reader, ok := r.(byteScanReader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &msgpackDecoder{reader: reader, decoder: codec.NewDecoder(reader, &codec.MsgpackHandle{})}
+}
+
+// A reader which allows peeking the next byte.
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+type msgpackEncoder struct {
+	encoder *codec.Encoder
+}
+
+// Encode implements the Encoder interface.
+func (m *msgpackEncoder) Encode(frame Frame) error {
+	return m.encoder.Encode(&msgpackFrame{Kind: frame.Kind, ID: frame.ID, Origin: frame.Origin, Sequence: frame.Sequence, Headers: frame.Headers, Data: frame.Data})
+}
+
+type msgpackDecoder struct {
+	reader  byteScanReader
+	decoder *codec.Decoder
+}
+
+// Decode implements the Decoder interface.
+func (m *msgpackDecoder) Decode() (Frame, error) {
+	legacy, err := m.isLegacy()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if legacy {
+		var data []byte
+		if err = m.decoder.Decode(&data); err != nil {
+			return Frame{}, err
+		}
+		return Frame{Kind: KindMessage, Data: data}, nil
+	}
+
+	var frame msgpackFrame
+	if err := m.decoder.Decode(&frame); err != nil {
+		return Frame{}, err
+	}
+	return Frame{Kind: frame.Kind, ID: frame.ID, Origin: frame.Origin, Sequence: frame.Sequence, Headers: frame.Headers, Data: frame.Data}, nil
+}
+
+// Verify if the next frame is in the previous format, holding only the
+// payload. Frames are msgpack arrays, the previous format is not.
+func (m *msgpackDecoder) isLegacy() (bool, error) {
+	first, err := m.reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+
+	if err = m.reader.UnreadByte(); err != nil {
+		return false, err
+	}
+	return !isMsgpackArray(first), nil
+}
+
+// Verify if the byte starts a msgpack array, either fixarray, array 16 or array 32.
+func isMsgpackArray(first byte) bool {
+	return first&0xf0 == 0x90 || first == 0xdc || first == 0xdd
+}
+
+// LengthPrefixedCodec is a plain binary Codec.
+// Each frame is written as a 4 bytes big-endian unsigned length,
+// followed by that amount of bytes holding the frame body. This
+// framing can be implemented by any peer without additional libraries.
+//
+// The body starts with 1 byte for the version of the layout, currently 1,
+// then 1 byte for the kind, 8 bytes for the identifier, 8 bytes for the
+// origin and 8 bytes for the sequence. Then 2 bytes holding the amount of
+// headers, followed by each header as 2 bytes of key length, the key, 4 bytes
+// of value length and the value. The remaining bytes of the body are the
+// payload. All integers are unsigned and big-endian. Frames with another
+// version are rejected with ErrUnknownVersion.
+//
+// The payload is read directly into a pooled buffer, which can be
+// returned to the pool using Datagram.Release.
+type LengthPrefixedCodec struct {
+	// Maximum size accepted for a single frame, frames bigger than
+	// this are rejected. Zero means a default of 64 MiB.
+	MaxFrameSize uint32
+}
+
+func (l LengthPrefixedCodec) maxFrameSize() uint32 {
+	if l.MaxFrameSize == 0 {
+		return defaultMaxFrameSize
+	}
+	return l.MaxFrameSize
+}
+
+// NewEncoder implements the Codec interface.
+func (l LengthPrefixedCodec) NewEncoder(w io.Writer) Encoder {
+	return &lengthPrefixedEncoder{writer: w, max: l.maxFrameSize()}
+}
+
+// NewDecoder implements the Codec interface.
+func (l LengthPrefixedCodec) NewDecoder(r io.Reader) Decoder {
+	return &lengthPrefixedDecoder{reader: r, max: l.maxFrameSize()}
+}
+
+type lengthPrefixedEncoder struct {
+	writer io.Writer
+	max    uint32
+	header [lengthPrefixSize + fixedBodySize]byte
+}
+
+// Encode implements the Encoder interface.
+func (l *lengthPrefixedEncoder) Encode(frame Frame) error {
+	if len(frame.Headers) > math.MaxUint16 {
+		return ErrFrameTooLarge
+	}
+
+	size := uint64(fixedBodySize + len(frame.Data))
+	for key, value := range frame.Headers {
+		if len(key) > math.MaxUint16 {
+			return ErrFrameTooLarge
+		}
+		size += uint64(headerKeySize + len(key) + headerValueSize + len(value))
+	}
+
+	if size > uint64(l.max) {
+		return ErrFrameTooLarge
+	}
+
+	binary.BigEndian.PutUint32(l.header[:], uint32(size))
+	fields := l.header[lengthPrefixSize:]
+	fields[0] = lengthPrefixedVersion
+	fields[versionSize] = byte(frame.Kind)
+	binary.BigEndian.PutUint64(fields[versionSize+kindSize:], frame.ID)
+	binary.BigEndian.PutUint64(fields[versionSize+kindSize+idSize:], frame.Origin)
+	binary.BigEndian.PutUint64(fields[versionSize+kindSize+idSize+originSize:], frame.Sequence)
+	binary.BigEndian.PutUint16(fields[versionSize+kindSize+idSize+originSize+sequenceSize:], uint16(len(frame.Headers)))
+	if _, err := l.writer.Write(l.header[:]); err != nil {
+		return err
+	}
+
+	for key, value := range frame.Headers {
+		binary.BigEndian.PutUint16(l.header[:], uint16(len(key)))
+		if _, err := l.writer.Write(l.header[:headerKeySize]); err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(l.writer, key); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(l.header[:], uint32(len(value)))
+		if _, err := l.writer.Write(l.header[:headerValueSize]); err != nil {
+			return err
+		}
+
+		if _, err := l.writer.Write(value); err != nil {
+			return err
+		}
+	}
+	_, err := l.writer.Write(frame.Data)
+	return err
+}
+
+type lengthPrefixedDecoder struct {
+	reader io.Reader
+	max    uint32
+	header [lengthPrefixSize]byte
+}
+
+// Decode implements the Decoder interface.
+func (l *lengthPrefixedDecoder) Decode() (Frame, error) {
+	if _, err := io.ReadFull(l.reader, l.header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(l.header[:])
+	if size > l.max {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	// The buffer is grown to fit the whole body, so reading into
+	// its free space and writing it back in place does not allocate.
+	buffer := acquireBuffer(int(size))
+	body := buffer.Bytes()[:size]
+	if _, err := io.ReadFull(l.reader, body); err != nil {
+		releaseBuffer(buffer)
+		return Frame{}, err
+	}
+	buffer.Write(body)
+
+	frame, read, err := readBody(body)
+	if err != nil {
+		releaseBuffer(buffer)
+		return Frame{}, err
+	}
+
+	// Skip the fixed fields and headers, so the buffer holds only the payload.
+	buffer.Next(read)
+	frame.Data = buffer.Bytes()
+	frame.buffer = buffer
+	return frame, nil
+}
+
+// Parse the fields before the payload, returning the amount of bytes read.
+// Headers are copied, so they are not affected when the buffer is released.
+func readBody(body []byte) (Frame, int, error) {
+	if len(body) < fixedBodySize {
+		return Frame{}, 0, ErrMalformedFrame
+	}
+
+	if body[0] != lengthPrefixedVersion {
+		return Frame{}, 0, ErrUnknownVersion
+	}
+
+	frame := Frame{
+		Kind:     FrameKind(body[versionSize]),
+		ID:       binary.BigEndian.Uint64(body[versionSize+kindSize:]),
+		Origin:   binary.BigEndian.Uint64(body[versionSize+kindSize+idSize:]),
+		Sequence: binary.BigEndian.Uint64(body[versionSize+kindSize+idSize+originSize:]),
+	}
+	count := int(binary.BigEndian.Uint16(body[versionSize+kindSize+idSize+originSize+sequenceSize:]))
+	offset := fixedBodySize
+	if count == 0 {
+		return frame, offset, nil
+	}
+
+	frame.Headers = make(map[string][]byte, count)
+	for i := 0; i < count; i++ {
+		if len(body)-offset < headerKeySize {
+			return Frame{}, 0, ErrMalformedFrame
+		}
+		keySize := int(binary.BigEndian.Uint16(body[offset:]))
+		offset += headerKeySize
+		if len(body)-offset < keySize+headerValueSize {
+			return Frame{}, 0, ErrMalformedFrame
+		}
+		key := string(body[offset : offset+keySize])
+		offset += keySize
+
+		valueSize := uint64(binary.BigEndian.Uint32(body[offset:]))
+		offset += headerValueSize
+		if uint64(len(body)-offset) < valueSize {
+			return Frame{}, 0, ErrMalformedFrame
+		}
+		value := make([]byte, valueSize)
+		copy(value, body[offset:])
+		offset += int(valueSize)
+		frame.Headers[key] = value
+	}
+	return frame, offset, nil
+}
@@ -17,18 +17,53 @@ package proletariat
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"time"
 )
 
+const (
+	defaultRetryAttempts = 3
+	defaultRetryTimeout  = time.Second
+)
+
 var (
-	ErrNotTCP        = errors.New("address is not TCP")
-	ErrInvalidAddr   = errors.New("address can not be used")
-	ErrAlreadyClosed = errors.New("communication was already closed")
+	ErrNotTCP          = errors.New("address is not TCP")
+	ErrInvalidAddr     = errors.New("address can not be used")
+	ErrAlreadyClosed   = errors.New("communication was already closed")
+	ErrMissingTLS      = errors.New("tls configuration is required")
+	ErrAddrInUse       = errors.New("address already in use")
+	ErrFrameTooLarge   = errors.New("frame exceeds the maximum size")
+	ErrMalformedFrame  = errors.New("frame is malformed")
+	ErrUnknownVersion  = errors.New("frame version is not supported")
+	ErrNotRequest      = errors.New("datagram is not a request")
+	ErrNotAcknowledged = errors.New("message was not acknowledged")
+	ErrPeerBackoff     = errors.New("peer is cooling down after failing to connect")
+	ErrQueueFull       = errors.New("outbound queue is full")
+	ErrMessageDropped  = errors.New("message dropped from full outbound queue")
+	ErrReceiverBusy    = errors.New("receiver is not handling the messages")
+	ErrUnknownType     = errors.New("no handler for the message type")
+	ErrMissingError    = errors.New("error to reply is nil")
 )
 
+// RemoteError is the error replied by the peer to a request.
+type RemoteError struct {
+	// Message of the error replied.
+	Message string
+}
+
+func (r *RemoteError) Error() string {
+	return r.Message
+}
+
+// Is reports if the target error has the same message, so the errors
+// of this package replied by the peer can be verified with errors.Is.
+func (r *RemoteError) Is(target error) bool {
+	return target != nil && target.Error() == r.Message
+}
+
 // Address is the peer address
 type Address string
 
@@ -45,9 +80,117 @@ type Configuration struct {
 	// Connections can be pooled, this is the max size.
 	PoolSize int
 
+	// Limits for how long pooled connections are kept.
+	Pool PoolPolicy
+
 	// The parent context to handle the life-cycle of
 	// the primitive.
 	Ctx context.Context
+
+	// When present, connections are secured using TLS with
+	// the given configuration instead of plain TCP.
+	TLS *tls.Config
+
+	// Factory to create the Transport used by the primitive.
+	// When present, takes precedence over the TLS configuration.
+	Transport TransportFactory
+
+	// Codec used to write and read messages on the connections.
+	// When not present, the MsgpackCodec is used.
+	Codec Codec
+
+	// When enabled, every sent message is acknowledged by the peer after
+	// it is published to be received, and Send only returns after the
+	// acknowledgement. Unacknowledged messages are sent again following
+	// the retry policy, so the peer may receive them more than once.
+	Acknowledge bool
+
+	// Policy to send again messages that were not acknowledged.
+	Retry RetryPolicy
+
+	// Deduplication of received messages, so a message sent more
+	// than once is delivered only once.
+	Deduplication Deduplication
+
+	// When enabled, messages sent to the same peer are received in the
+	// order they were sent, even when sent over different connections.
+	// Both peers must enable ordering.
+	Ordered bool
+
+	// Policy to wait for messages received out of order.
+	Reorder ReorderPolicy
+
+	// Address advertised to peers during the handshake, so they can
+	// reach this primitive. When not present, the address of the
+	// transport is used.
+	Advertise Address
+
+	// Optional identifier of this node, advertised during the handshake.
+	NodeID string
+
+	// Heartbeats to detect which peers are alive.
+	Heartbeat HeartbeatPolicy
+
+	// Policy to wait before connecting again to peers that failed.
+	Reconnect ReconnectPolicy
+
+	// Policy to stop sending to peers failing consecutively.
+	CircuitBreaker CircuitBreakerPolicy
+
+	// Queues of the messages sent asynchronously.
+	Async AsyncPolicy
+
+	// Policy to gather messages written to the same connection and
+	// flush them together.
+	Batch BatchPolicy
+
+	// Credits limiting the messages sent over a connection and not
+	// handled by the receiver yet.
+	FlowControl FlowControlPolicy
+
+	// Capacity of the Receive channel and what happens when it is full.
+	Receive ReceivePolicy
+
+	// Interceptors invoked in order for every message sent, including
+	// requests and replies, before writing it.
+	Outbound []Interceptor
+
+	// Interceptors invoked in order for every message received,
+	// including requests and replies, before handling it.
+	Inbound []Interceptor
+
+	// Source of the current time. When not present, the system time is used.
+	Clock Clock
+}
+
+// RetryPolicy defines how unacknowledged messages are sent again.
+// Each attempt that fails closes the connection used, so the next
+// attempt is sent over a new connection.
+type RetryPolicy struct {
+	// Maximum attempts to deliver a message, including the first one.
+	// Zero means a default of 3 attempts.
+	Attempts int
+
+	// Time to wait for the acknowledgement of each attempt.
+	// Zero means a default of 1 second.
+	Timeout time.Duration
+
+	// Time to wait before sending again.
+	Backoff time.Duration
+}
+
+func (r RetryPolicy) attempts() int {
+	if r.Attempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return r.Attempts
+}
+
+func (r RetryPolicy) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultRetryTimeout
+	}
+	return r.Timeout
 }
 
 // Communication is the base communication interface that should be implemented.
@@ -64,11 +207,64 @@ type Communication interface {
 	// Send the given data to the connect at the given address.
 	Send(Address, []byte) error
 
+	// SendWithHeaders send the given data along with the headers
+	// to the connection at the given address.
+	SendWithHeaders(Address, map[string][]byte, []byte) error
+
+	// SendAsync queues the given data to be sent to the connection at
+	// the given address, without waiting. The returned channel receives
+	// the result of sending, the same as Send would return.
+	SendAsync(Address, []byte) <-chan error
+
 	// Receive listen for incoming messages.
 	Receive() <-chan Datagram
 
+	// Request send the given data to the connection at the given
+	// address and waits for the reply. Returns the context error if
+	// the context is done before the reply arrives, so the timeout of
+	// each request is defined using the context. The deadline of the
+	// context also bounds dialing and waiting for credits.
+	Request(context.Context, Address, []byte) ([]byte, error)
+
+	// RequestWithHeaders send the given data along with the headers
+	// and waits for the reply, the same as Request.
+	RequestWithHeaders(context.Context, Address, map[string][]byte, []byte) ([]byte, error)
+
+	// Reply send the given data as the response for the received
+	// datagram. The reply is written on the same connection the
+	// request was received, failing if the datagram is not a request.
+	Reply(Datagram, []byte) error
+
+	// ReplyError send the error as the response for the received
+	// datagram, the request fails with a RemoteError holding the
+	// error message. Fails with ErrMissingError if the error is nil.
+	ReplyError(Datagram, error) error
+
 	// Addr returns the current communication address.
 	Addr() net.Addr
+
+	// Statistics returns a snapshot of the connections.
+	Statistics() PoolStatistics
+
+	// IsAlive returns `true` if the peer at the address answers the
+	// heartbeats. Peers not known are not alive.
+	IsAlive(Address) bool
+
+	// PeerEvents listen for changes of the known peers liveness.
+	PeerEvents() <-chan PeerEvent
+
+	// DropEvents listen for received messages dropped because the
+	// Receive channel was full.
+	DropEvents() <-chan DropEvent
+
+	// ReceiveStatistics returns a snapshot of the messages published
+	// to the Receive channel and the ones dropped.
+	ReceiveStatistics() ReceiveStatistics
+
+	// Subscribe creates a subscription receiving the messages matching
+	// the filter, in a channel created with the policy. Messages matching
+	// any subscription are not published to the Receive channel.
+	Subscribe(Filter, ReceivePolicy) (*Subscription, error)
 }
 
 // Datagram represent a datagram for the transport layer.
@@ -77,12 +273,62 @@ type Datagram struct {
 	// Received data from the underlining connection.
 	Data *bytes.Buffer
 
+	// Headers sent along with the data.
+	Headers map[string][]byte
+
 	// Errors received from the connection.
 	Err error
 
-	// Address that sent the message.
+	// Address that sent the message. When the peer completed the
+	// handshake, this is the address it advertised.
 	From Address
 
+	// Node identifier advertised by the peer, if any.
+	Node string
+
 	// Message destination.
 	To Address
+
+	// If the data is held by a pooled buffer.
+	pooled bool
+
+	// Kind of the received frame.
+	kind FrameKind
+
+	// Identifier of the received frame.
+	id uint64
+
+	// Identifier of the sending instance.
+	origin uint64
+
+	// Position between the messages of the sending instance.
+	sequence uint64
+
+	// Connection that received the datagram.
+	connection Connection
+}
+
+// IsRequest returns `true` if the sender is waiting for a reply.
+func (d Datagram) IsRequest() bool {
+	return d.kind == KindRequest
+}
+
+// Release returns the buffer holding the data to be reused when
+// receiving other messages. After released, the data must not be
+// used anymore and Release must not be called again.
+// Releasing is optional, buffers not released are garbage collected.
+func (d Datagram) Release() {
+	if d.pooled {
+		releaseBuffer(d.Data)
+	}
+}
+
+// Copy the datagram with its own payload, not held by a pooled buffer.
+func (d Datagram) clone() Datagram {
+	copied := d
+	copied.pooled = false
+	if d.Data != nil {
+		copied.Data = bytes.NewBuffer(append([]byte(nil), d.Data.Bytes()...))
+	}
+	return copied
 }
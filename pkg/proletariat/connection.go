@@ -14,7 +14,10 @@
 
 package proletariat
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 // Connection interface represents a connection between two peers.
 // The connection can be incoming, outgoing or duplex.
@@ -24,6 +27,18 @@ type Connection interface {
 	// Write sends the encoded date to the target peer.
 	Write([]byte) error
 
+	// WriteFrame sends the encoded frame to the target peer.
+	WriteFrame(Frame) error
+
+	// WriteFrameContext sends the encoded frame to the target peer,
+	// failing if the context is done while waiting to write.
+	WriteFrameContext(context.Context, Frame) error
+
 	// Listen start listening for incoming data.
 	Listen()
+
+	// Handshake sends the local identity to the peer, which answers
+	// with its own. Received datagrams are identified by the peer
+	// identity after the answer arrives.
+	Handshake() error
 }
@@ -0,0 +1,136 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDeduplicationCapacity = 1 << 16
+)
+
+// MessageIDHeader is the header holding an identifier chosen by the
+// sender. When present, the message is deduplicated by this identifier
+// instead of the one assigned to each Send, so calling Send again with
+// the same identifier after a failure delivers the message only once.
+const MessageIDHeader = ":id"
+
+// Deduplication configures the receiver side deduplication.
+// Messages are identified by the sender instance and the message
+// identifier, or the MessageIDHeader when present, so retries of
+// the same message are delivered only once.
+type Deduplication struct {
+	// Time a received message is remembered.
+	// Zero disables the deduplication.
+	Window time.Duration
+
+	// Maximum amount of messages remembered, the oldest are forgotten
+	// first. Zero means a default of 65536 messages.
+	Capacity int
+}
+
+// Identifies a message across all senders.
+type messageKey struct {
+	origin uint64
+	id     uint64
+
+	// Identifier chosen by the sender, replaces the id when present.
+	name string
+}
+
+// A message remembered by the deduplicator.
+type seenMessage struct {
+	key  messageKey
+	seen time.Time
+}
+
+// Bounded and time-windowed set of received messages.
+type deduplicator struct {
+	mutex *sync.Mutex
+
+	// How long messages are remembered.
+	window time.Duration
+
+	// Maximum amount of messages remembered.
+	capacity int
+
+	// Remembered messages, by key.
+	messages map[messageKey]*list.Element
+
+	// Remembered messages, from oldest to newest.
+	order *list.List
+}
+
+func newDeduplicator(configuration Deduplication) *deduplicator {
+	capacity := configuration.Capacity
+	if capacity <= 0 {
+		capacity = defaultDeduplicationCapacity
+	}
+	return &deduplicator{
+		mutex:    &sync.Mutex{},
+		window:   configuration.Window,
+		capacity: capacity,
+		messages: make(map[messageKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Verify if the message was already received inside the window.
+// If not, the message is remembered and `false` is returned.
+func (d *deduplicator) isDuplicate(key messageKey) bool {
+	now := time.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.evict(now)
+	if _, ok := d.messages[key]; ok {
+		return true
+	}
+
+	d.messages[key] = d.order.PushBack(seenMessage{key: key, seen: now})
+	return false
+}
+
+// Forget the message, so it is accepted when received again.
+func (d *deduplicator) forget(key messageKey) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if element, ok := d.messages[key]; ok {
+		d.order.Remove(element)
+		delete(d.messages, key)
+	}
+}
+
+// Remove the messages outside the window or exceeding the capacity.
+func (d *deduplicator) evict(now time.Time) {
+	for oldest := d.order.Front(); oldest != nil; oldest = d.order.Front() {
+		message := oldest.Value.(seenMessage)
+		if d.order.Len() < d.capacity && now.Sub(message.seen) < d.window {
+			return
+		}
+		d.order.Remove(oldest)
+		delete(d.messages, message.key)
+	}
+}
+
+// Identifies the received datagram across all senders.
+func (d Datagram) key() messageKey {
+	if name, ok := d.Headers[MessageIDHeader]; ok {
+		return messageKey{origin: d.origin, name: string(name)}
+	}
+	return messageKey{origin: d.origin, id: d.id}
+}
@@ -16,21 +16,34 @@ package proletariat
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	minPollDelay = 5 * time.Millisecond
 	maxPollDelay = 500 * time.Millisecond
+
+	// Header of the reply holding the error message.
+	replyErrorHeader = "error"
 )
 
 // DefaultCommunication default struct that implements the Communication interface.
 // Using this implementation is possible to send and receive messages.
 type DefaultCommunication struct {
-	// Synchronize operations on available connections.
+	// Sequence to identify the sent messages.
+	// Accessed atomically, kept first to be 64-bit aligned.
+	sequence uint64
+
+	// Random identifier of this instance, sent with every message.
+	origin uint64
+
+	// Synchronize operations on pending frames.
 	mutex *sync.Mutex
 
 	// Flag to transition between states.
@@ -45,11 +58,44 @@ type DefaultCommunication struct {
 	// Transport used to send and receive messages.
 	transport Transport
 
+	// Identity advertised to the peers.
+	identity Identity
+
+	// Dials the peers, backing off the ones failing.
+	dialer *dialer
+
+	// Stops sending to peers failing consecutively.
+	breakers *circuitBreakers
+
+	// Messages waiting to be sent asynchronously.
+	outbound *outboundQueues
+
 	// Channel that will receive data from another connections.
 	listener *SharedChannel
 
-	// All established connections.
-	connections map[Address][]Connection
+	// Delivers the received data to the subscriptions or the listener.
+	subscribers *subscribers
+
+	// Open connections and the ones available to send messages.
+	pool *connectionPool
+
+	// Frames waiting for a reply or acknowledgement, by identifier.
+	pending map[uint64]chan Datagram
+
+	// Messages already received, nil if deduplication is disabled.
+	deduplicator *deduplicator
+
+	// Sequence of the ordered messages sent, by destination.
+	sequences map[Address]*sendSequence
+
+	// Delivers received messages in order, nil if ordering is disabled.
+	sequencer *sequencer
+
+	// Detects which known peers are alive.
+	detector *failureDetector
+
+	// Counts the received messages dropped.
+	drops *dropMonitor
 
 	// Primitive context.
 	ctx context.Context
@@ -63,50 +109,109 @@ type DefaultCommunication struct {
 
 func NewCommunication(configuration Configuration) (Communication, error) {
 	ctx, cancel := context.WithCancel(configuration.Ctx)
-	tcp, err := NewTCPTransport(ctx, configuration.Address)
+	var origin [8]byte
+	if _, err := rand.Read(origin[:]); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	transport, err := newTransport(ctx, configuration)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
 
+	identity := Identity{Address: configuration.Advertise, Node: configuration.NodeID}
+	if len(identity.Address) == 0 {
+		identity.Address = Address(transport.Addr().String())
+	}
+
+	clock := configuration.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	// Messages dropped by the channel are reported as events.
+	drops := newDropMonitor()
+	listener := newSharedChannel(configuration.Receive, drops.record)
 	comm := &DefaultCommunication{
+		origin:        binary.BigEndian.Uint64(origin[:]),
 		mutex:         &sync.Mutex{},
 		flag:          &Flag{},
 		handler:       NewRoutineHandler(),
 		configuration: configuration,
-		transport:     tcp,
-		listener:      NewSharedChannel(),
-		connections:   make(map[Address][]Connection),
+		transport:     transport,
+		identity:      identity,
+		listener:      listener,
+		subscribers:   newSubscribers(listener, drops.record),
+		pool:          newConnectionPool(configuration.PoolSize, configuration.Pool),
+		detector:      newFailureDetector(configuration.Heartbeat),
+		drops:         drops,
+		pending:       make(map[uint64]chan Datagram),
+		sequences:     make(map[Address]*sendSequence),
 		ctx:           ctx,
 		cancel:        cancel,
 		closed:        make(chan bool, 1),
 	}
+	comm.breakers = newCircuitBreakers(configuration.CircuitBreaker, clock)
+	comm.outbound = newOutboundQueues(configuration.Async, comm.serve)
+	comm.dialer = newDialer(configuration.Reconnect, clock, transport.Dial)
+	if configuration.Deduplication.Window > 0 {
+		comm.deduplicator = newDeduplicator(configuration.Deduplication)
+	}
+	if configuration.Ordered {
+		comm.sequencer = newSequencer(configuration.Reorder, comm.publish)
+	}
 	return comm, nil
 }
 
-// When a new connection request is received by the server this method is
-// initiated. Using the given net connection a wrapper is created for this
-// incoming request.
-// This incoming connection request, will remain open until the peer closes,
-// polling and for every received data will publish to the listener channel.
-// After created, since this connection is created only to receive messages
-// it will not be stored for the in-memory connections.
-func (d *DefaultCommunication) handleIncomingConnection(conn net.Conn) {
-	select {
-	case <-d.ctx.Done():
-		return
-	default:
-		ctx, cancel := context.WithCancel(d.ctx)
-		incoming := ConnectionConfiguration{
-			Timeout:    d.configuration.Timeout,
-			Read:       d.listener,
-			Ctx:        ctx,
-			Cancel:     cancel,
-			Connection: conn,
-			Target:     Address(conn.RemoteAddr().String()),
-		}
-		connection := NewNetworkConnection(incoming)
-		d.handler.Spawn(connection.Listen)
+// Creates the transport described by the configuration.
+func newTransport(ctx context.Context, configuration Configuration) (Transport, error) {
+	if configuration.Transport != nil {
+		return configuration.Transport(ctx, configuration.Address)
+	}
+	if configuration.TLS != nil {
+		return NewTLSTransport(ctx, configuration.Address, configuration.TLS)
+	}
+	return NewTCPTransport(ctx, configuration.Address)
+}
+
+// Create a new proletariat.Connection wrapping the net connection.
+// Every connection listens for incoming data, even the ones created
+// to send messages, since replies are received through them.
+// Incoming connections are pooled by the identity of the peer after
+// the handshake, so they are also used to send messages.
+func (d *DefaultCommunication) newConnection(conn net.Conn, address Address, incoming bool) Connection {
+	ctx, cancel := context.WithCancel(d.ctx)
+	config := ConnectionConfiguration{
+		Timeout:     d.configuration.Timeout,
+		Read:        d.subscribers,
+		Connection:  conn,
+		Target:      address,
+		Ctx:         ctx,
+		Cancel:      cancel,
+		Codec:       d.configuration.Codec,
+		Handle:      d.handle,
+		Delivered:   d.delivered,
+		Identity:    d.identity,
+		Batch:       d.configuration.Batch,
+		FlowControl: d.configuration.FlowControl,
+		Inbound:     d.configuration.Inbound,
+	}
+	if incoming {
+		config.Identified = d.identified
+	}
+	return NewNetworkConnection(config)
+}
+
+// Listen the connection until it fails or is closed. A connection
+// that is not listening anymore is removed from the pool, so it
+// is not used to send messages.
+func (d *DefaultCommunication) listen(connection Connection) func() {
+	return func() {
+		connection.Listen()
+		d.pool.forget(connection)
+		connection.Close()
 	}
 }
 
@@ -120,83 +225,74 @@ func (d *DefaultCommunication) isClosed() bool {
 	}
 }
 
-// For a given address, create a new connection instance if possible.
-func (d *DefaultCommunication) resolveConnection(address Address) (Connection, error) {
-	if connection := d.getActiveConnection(address); connection != nil {
-		return connection, nil
+// Establish a connection with another peer using the available transport if possible.
+func (d *DefaultCommunication) establishNewConnection(ctx context.Context, address Address) (Connection, error) {
+	timeout, err := d.dialTimeout(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return d.establishNewConnection(address)
-}
 
-// Retrieve a connection for the in-memory available connections.
-func (d *DefaultCommunication) getActiveConnection(address Address) Connection {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	connections, ok := d.connections[address]
-	if !ok || len(connections) == 0 {
-		return nil
+	conn, err := d.dialer.connect(address, timeout)
+	if err != nil {
+		return nil, err
 	}
 
-	var connection Connection
-	size := len(connections)
-	connection, connections[size-1] = connections[size-1], nil
-	d.connections[address] = connections[:size-1]
-	return connection
-}
+	connection := d.newConnection(conn, address, false)
+	if !d.pool.track(connection, false) || !d.handler.TrySpawn(d.listen(connection)) {
+		d.pool.forget(connection)
+		connection.Close()
+		return nil, ErrAlreadyClosed
+	}
 
-// Establish a connection with another peer using the available transport if possible.
-func (d *DefaultCommunication) establishNewConnection(address Address) (Connection, error) {
-	conn, err := d.transport.Dial(address, d.configuration.Timeout)
-	if err != nil {
+	if err = connection.Handshake(); err != nil {
+		connection.Close()
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(d.ctx)
-	config := ConnectionConfiguration{
-		Timeout:    d.configuration.Timeout,
-		Read:       d.listener,
-		Connection: conn,
-		Target:     address,
-		Ctx:        ctx,
-		Cancel:     cancel,
-	}
-	return NewNetworkConnection(config), nil
+	return connection, nil
 }
 
-func (d *DefaultCommunication) maybeSaveConnection(address Address, connection Connection) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	available := d.connections[address]
-	if d.configuration.PoolSize > 0 && len(available) > d.configuration.PoolSize {
-		return
+// Invoked when the peer of an incoming connection identifies itself.
+// The connection is stored in the pool of the advertised address, so it
+// is used to send messages to the peer. If the pool is full, the
+// connection is only used to receive messages, as it is when the
+// advertised address could not be verified.
+func (d *DefaultCommunication) identified(connection Connection, identity Identity) {
+	if len(identity.Address) > 0 {
+		d.pool.release(identity.Address, connection)
+		d.detector.monitor(identity.Address)
 	}
-	d.connections[address] = append(available, connection)
 }
 
-// Given a connection, create a new proletariat.Connection and store it on the memory map.
-func (d *DefaultCommunication) saveNewConnection(conn net.Conn) {
-	address := Address(conn.RemoteAddr().String())
-	ctx, cancel := context.WithCancel(d.ctx)
-	config := ConnectionConfiguration{
-		Timeout:    d.configuration.Timeout,
-		Read:       d.listener,
-		Connection: conn,
-		Target:     address,
-		Ctx:        ctx,
-		Cancel:     cancel,
+// Time to dial a peer, bounded by the deadline of the context.
+func (d *DefaultCommunication) dialTimeout(ctx context.Context) (time.Duration, error) {
+	timeout := d.configuration.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+
+		if timeout <= 0 || remaining < timeout {
+			return remaining, nil
+		}
 	}
-	d.maybeSaveConnection(address, NewNetworkConnection(config))
+	return timeout, nil
 }
 
 // Accept a incoming connection if the communication is not done.
+// The connection will remain open until the peer closes, and for every
+// received data will publish to the listener channel.
 func (d *DefaultCommunication) acceptIncomingConnection(conn net.Conn) {
 	select {
 	case <-d.ctx.Done():
-		return
+		conn.Close()
 	default:
-		d.saveNewConnection(conn)
-		d.handler.Spawn(func() {
-			d.handleIncomingConnection(conn)
-		})
+		address := Address(conn.RemoteAddr().String())
+		connection := d.newConnection(conn, address, true)
+		if !d.pool.track(connection, true) || !d.handler.TrySpawn(d.listen(connection)) {
+			d.pool.forget(connection)
+			connection.Close()
+		}
 	}
 }
 
@@ -204,23 +300,21 @@ func (d *DefaultCommunication) acceptIncomingConnection(conn net.Conn) {
 func (d *DefaultCommunication) Close() error {
 	if d.flag.Inactivate() {
 		defer d.handler.Close()
-		d.cancel()
-		d.mutex.Lock()
-		defer d.mutex.Unlock()
 
-		for key, connections := range d.connections {
-			for _, connection := range connections {
-				if err := connection.Close(); err != nil {
-					return err
-				}
-			}
-			delete(d.connections, key)
+		// Connections are still read while flushing pending batches,
+		// the peer may be waiting for a frame to be read first.
+		d.pool.close()
+		d.cancel()
+		if d.sequencer != nil {
+			d.sequencer.close()
 		}
+		d.detector.close()
+		d.drops.close()
 		if err := d.transport.Close(); err != nil {
 			return err
 		}
 		<-d.closed
-		return d.listener.Close()
+		return d.subscribers.close()
 	}
 	return nil
 }
@@ -230,11 +324,20 @@ func (d *DefaultCommunication) Close() error {
 // to start the life-cycle asynchronously.
 // The Accept method to receive a new connection is a blocking call.
 func (d *DefaultCommunication) Start() {
+	// Closing waits for this channel, even if started after closed.
+	defer close(d.closed)
 	if d.isClosed() {
 		return
 	}
 
-	defer close(d.closed)
+	if d.configuration.Pool.enabled() {
+		d.handler.TrySpawn(d.reap)
+	}
+
+	if d.configuration.Heartbeat.Interval > 0 {
+		d.handler.TrySpawn(d.heartbeat)
+	}
+
 	var pollDelay = minPollDelay
 	for {
 		pollDelay = min(pollDelay*2, maxPollDelay)
@@ -256,30 +359,509 @@ func (d *DefaultCommunication) Start() {
 	}
 }
 
+// Close the pooled connections exceeding the limits periodically,
+// until the primitive is closed.
+func (d *DefaultCommunication) reap() {
+	ticker := time.NewTicker(d.configuration.Pool.reapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.pool.reap()
+		}
+	}
+}
+
+// Ping the known peers periodically, until the primitive is closed.
+func (d *DefaultCommunication) heartbeat() {
+	ticker := time.NewTicker(d.configuration.Heartbeat.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.detector.evaluate()
+			pings := d.detector.ping(func() uint64 {
+				return atomic.AddUint64(&d.sequence, 1)
+			})
+			for address, id := range pings {
+				// A peer that is slow to dial does not delay the others.
+				address, id := address, id
+				d.handler.TrySpawn(func() {
+					d.ping(address, id)
+				})
+			}
+		}
+	}
+}
+
+// Ping the peer, the answer is received as any other frame.
+func (d *DefaultCommunication) ping(address Address, id uint64) {
+	connection, err := d.write(d.ctx, address, &Frame{Kind: KindPing, ID: id})
+	if err == nil {
+		d.releaseConnection(address, connection)
+	}
+}
+
 // Send implements the Communication interface.
 func (d *DefaultCommunication) Send(address Address, data []byte) error {
+	return d.send(address, Frame{Data: data})
+}
+
+// SendWithHeaders implements the Communication interface.
+func (d *DefaultCommunication) SendWithHeaders(address Address, headers map[string][]byte, data []byte) error {
+	return d.send(address, Frame{Headers: headers, Data: data})
+}
+
+// SendAsync implements the Communication interface.
+func (d *DefaultCommunication) SendAsync(address Address, data []byte) <-chan error {
+	message := outboundMessage{data: data, result: make(chan error, 1)}
 	if d.isClosed() {
-		return ErrAlreadyClosed
+		message.complete(ErrAlreadyClosed)
+	} else {
+		d.outbound.enqueue(d.ctx, address, message)
 	}
+	return message.result
+}
 
-	connection, err := d.resolveConnection(address)
+// Start the writers of the peer queue. Writers waiting for longer
+// than the idle timeout remove the queue, stopping all of them.
+// Returns `false` if the primitive is already closed.
+func (d *DefaultCommunication) serve(address Address, queue *outboundQueue) bool {
+	for i := 0; i < d.configuration.Async.writers(); i++ {
+		started := d.handler.TrySpawn(func() {
+			timeout := d.configuration.Async.idleTimeout()
+			idle := time.NewTimer(timeout)
+			defer idle.Stop()
+			for {
+				select {
+				case <-d.ctx.Done():
+					drainOutbound(queue.messages, ErrAlreadyClosed)
+					return
+				case <-queue.stopped:
+					return
+				case message := <-queue.messages:
+					message.complete(d.Send(address, message.data))
+
+					// The timer is drained if it fired meanwhile, so the reset is not lost.
+					if !idle.Stop() {
+						<-idle.C
+					}
+				case <-idle.C:
+					d.outbound.retire(address, queue)
+				}
+				idle.Reset(timeout)
+			}
+		})
+		if !started {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the frame using a connection to the given address.
+func (d *DefaultCommunication) send(address Address, frame Frame) error {
+	frame, err := d.intercept(address, frame)
 	if err != nil {
 		return err
 	}
 
-	if err = connection.Write(data); err != nil {
-		connection.Close()
+	if d.configuration.Acknowledge && frame.Kind == KindMessage {
+		return d.sendReliable(address, frame)
+	}
+
+	connection, err := d.write(d.ctx, address, &frame)
+	if err != nil {
 		return err
 	}
-	d.maybeSaveConnection(address, connection)
+	d.releaseConnection(address, connection)
 	return nil
 }
 
+// Write the frame using a connection to the given address, returning the
+// connection used. The connection must be released after used.
+// Frames without an identifier receive the next one in the sequence.
+// Dialing and waiting for credits are bounded by the context.
+func (d *DefaultCommunication) write(ctx context.Context, address Address, frame *Frame) (Connection, error) {
+	if d.isClosed() {
+		return nil, ErrAlreadyClosed
+	}
+
+	if err := d.breakers.allow(address); err != nil {
+		return nil, err
+	}
+
+	if frame.ID == 0 {
+		frame.ID = atomic.AddUint64(&d.sequence, 1)
+	}
+	frame.Origin = d.origin
+
+	connection, err := d.writeFrame(ctx, address, frame)
+	d.breakers.record(address, err)
+	return connection, err
+}
+
+// Write the frame using a pooled connection, or a new one if none is available.
+func (d *DefaultCommunication) writeFrame(ctx context.Context, address Address, frame *Frame) (Connection, error) {
+	// A pooled connection can be closed by the peer, which is only
+	// noticed when writing, so the frame is written again on a new one.
+	if connection := d.pool.acquire(address); connection != nil {
+		err := d.handOver(ctx, address, connection, frame)
+		if err == nil {
+			d.detector.monitor(address)
+			return connection, nil
+		}
+
+		// The connection is still usable when the frame is refused or
+		// the peer is not handling the messages, a new connection would
+		// refuse it again or bypass the flow control.
+		if !isTransportFailure(err) {
+			d.releaseConnection(address, connection)
+			return nil, err
+		}
+		connection.Close()
+	}
+
+	connection, err := d.establishNewConnection(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.handOver(ctx, address, connection, frame); err != nil {
+		if isTransportFailure(err) {
+			connection.Close()
+		} else {
+			d.releaseConnection(address, connection)
+		}
+		return nil, err
+	}
+	d.detector.monitor(address)
+	return connection, nil
+}
+
+// Hand the frame to the connection. Ordered messages receive the next
+// sequence of the destination before written, so messages to the same
+// peer are written concurrently and the receiver restores the order.
+// Retries keep their sequence. When the frame is refused without being
+// written, the receiver is told to skip the sequence instead of waiting,
+// and a retry receives a new one. A frame lost with the connection
+// leaves a gap the receiver waits for up to the reorder timeout.
+func (d *DefaultCommunication) handOver(ctx context.Context, address Address, connection Connection, frame *Frame) error {
+	if d.isOrdered(*frame) && frame.Sequence == 0 {
+		frame.Sequence = d.sendSequence(address).next()
+	}
+
+	err := connection.WriteFrameContext(ctx, *frame)
+	if err != nil && frame.Sequence > 0 && !isTransportFailure(err) {
+		if connection.WriteFrame(Frame{Kind: KindSkip, Origin: frame.Origin, Sequence: frame.Sequence}) == nil {
+			frame.Sequence = 0
+		}
+	}
+	return err
+}
+
+// Verify if the frame is delivered in order by the receiver.
+func (d *DefaultCommunication) isOrdered(frame Frame) bool {
+	return d.configuration.Ordered && (frame.Kind == KindMessage || frame.Kind == KindReliable)
+}
+
+// The sequence of ordered messages for the given address.
+func (d *DefaultCommunication) sendSequence(address Address) *sendSequence {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	sequence, ok := d.sequences[address]
+	if !ok {
+		sequence = &sendSequence{}
+		d.sequences[address] = sequence
+	}
+	return sequence
+}
+
+// Return the connection to the pool, closing it if the pool is full.
+func (d *DefaultCommunication) releaseConnection(address Address, connection Connection) {
+	if !d.pool.release(address, connection) {
+		connection.Close()
+	}
+}
+
+// Write the frame and wait for the acknowledgement, sending again
+// following the retry policy.
+func (d *DefaultCommunication) sendReliable(address Address, frame Frame) error {
+	frame.Kind = KindReliable
+	frame.ID = atomic.AddUint64(&d.sequence, 1)
+	acknowledged := d.register(frame.ID)
+	defer d.unregister(frame.ID)
+
+	policy := d.configuration.Retry
+	var err error
+	for attempt := 0; attempt < policy.attempts(); attempt++ {
+		if attempt > 0 && policy.Backoff > 0 {
+			select {
+			case <-d.ctx.Done():
+				return ErrAlreadyClosed
+			case <-time.After(policy.Backoff):
+			}
+		}
+
+		var connection Connection
+		if connection, err = d.write(d.ctx, address, &frame); err != nil {
+			continue
+		}
+
+		select {
+		case <-d.ctx.Done():
+			d.releaseConnection(address, connection)
+			return ErrAlreadyClosed
+		case <-acknowledged:
+			d.releaseConnection(address, connection)
+			return nil
+		case <-time.After(policy.timeout()):
+			err = ErrNotAcknowledged
+			connection.Close()
+		}
+	}
+	return err
+}
+
+// Register a frame waiting for a response with the given identifier.
+func (d *DefaultCommunication) register(id uint64) <-chan Datagram {
+	response := make(chan Datagram, 1)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending[id] = response
+	return response
+}
+
+// Remove the frame waiting for a response.
+func (d *DefaultCommunication) unregister(id uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.pending, id)
+}
+
+// Request implements the Communication interface.
+// The connection used to send the request is not shared with other
+// requests until the reply arrives.
+func (d *DefaultCommunication) Request(ctx context.Context, address Address, data []byte) ([]byte, error) {
+	return d.request(ctx, address, Frame{Data: data})
+}
+
+// RequestWithHeaders implements the Communication interface.
+func (d *DefaultCommunication) RequestWithHeaders(ctx context.Context, address Address, headers map[string][]byte, data []byte) ([]byte, error) {
+	return d.request(ctx, address, Frame{Headers: headers, Data: data})
+}
+
+// Write the frame as a request and wait for the reply.
+func (d *DefaultCommunication) request(ctx context.Context, address Address, frame Frame) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	id := atomic.AddUint64(&d.sequence, 1)
+	response := d.register(id)
+	defer d.unregister(id)
+
+	frame.Kind, frame.ID = KindRequest, id
+	frame, err := d.intercept(address, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := d.write(ctx, address, &frame)
+	if err != nil {
+		return nil, err
+	}
+	defer d.releaseConnection(address, connection)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.ctx.Done():
+		return nil, ErrAlreadyClosed
+	case datagram := <-response:
+		if message, ok := datagram.Headers[replyErrorHeader]; ok {
+			return nil, &RemoteError{Message: string(message)}
+		}
+		return datagram.Data.Bytes(), nil
+	}
+}
+
+// Reply implements the Communication interface.
+func (d *DefaultCommunication) Reply(datagram Datagram, data []byte) error {
+	return d.reply(datagram, Frame{Kind: KindReply, ID: datagram.id, Data: data})
+}
+
+// ReplyError implements the Communication interface.
+func (d *DefaultCommunication) ReplyError(datagram Datagram, err error) error {
+	if err == nil {
+		return ErrMissingError
+	}
+
+	headers := map[string][]byte{replyErrorHeader: []byte(err.Error())}
+	return d.reply(datagram, Frame{Kind: KindReply, ID: datagram.id, Headers: headers})
+}
+
+// Write the reply on the connection the request was received.
+func (d *DefaultCommunication) reply(datagram Datagram, frame Frame) error {
+	if !datagram.IsRequest() || datagram.connection == nil {
+		return ErrNotRequest
+	}
+
+	if d.isClosed() {
+		return ErrAlreadyClosed
+	}
+
+	frame, err := d.intercept(datagram.From, frame)
+	if err != nil {
+		return err
+	}
+	return datagram.connection.WriteFrame(frame)
+}
+
+// Invoke the outbound interceptors with the frame content.
+// Returns the frame with the content modified by the interceptors.
+func (d *DefaultCommunication) intercept(address Address, frame Frame) (Frame, error) {
+	if len(d.configuration.Outbound) == 0 {
+		return frame, nil
+	}
+
+	message := &Message{Kind: frame.Kind, Peer: address, Headers: copyHeaders(frame.Headers), Data: frame.Data}
+	if err := intercept(d.configuration.Outbound, message); err != nil {
+		return frame, err
+	}
+	frame.Headers, frame.Data = message.Headers, message.Data
+	return frame, nil
+}
+
+// Intercepts the received datagrams that are not meant to the consumer.
+// Returns `true` if the datagram was consumed.
+func (d *DefaultCommunication) handle(datagram Datagram) bool {
+	switch datagram.kind {
+	case KindPing:
+		datagram.connection.WriteFrame(Frame{Kind: KindPong, ID: datagram.id})
+		return true
+	case KindPong:
+		d.detector.pong(datagram.id)
+		return true
+	case KindReply, KindAck:
+		d.mutex.Lock()
+		response, ok := d.pending[datagram.id]
+		delete(d.pending, datagram.id)
+		d.mutex.Unlock()
+
+		// The request can already be done, if the response arrived too late.
+		if ok {
+			response <- datagram
+		}
+		return true
+	case KindSkip:
+		if d.sequencer == nil || datagram.sequence == 0 || !d.sequencer.receive(datagram) {
+			datagram.Release()
+		}
+		return true
+	case KindMessage, KindReliable:
+		if d.deduplicator != nil && d.deduplicator.isDuplicate(datagram.key()) {
+			d.discard(datagram)
+			return true
+		}
+
+		if d.sequencer == nil || datagram.sequence == 0 {
+			return false
+		}
+
+		// Messages waiting for a missing one are delivered later.
+		if !d.sequencer.receive(datagram) {
+			d.discard(datagram)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Drop a datagram that was already received. Reliable messages are
+// acknowledged again, since the first acknowledgement was lost.
+func (d *DefaultCommunication) discard(datagram Datagram) {
+	if datagram.kind == KindReliable {
+		datagram.connection.WriteFrame(Frame{Kind: KindAck, ID: datagram.id})
+	}
+	datagram.Release()
+}
+
+// Publish the datagram to be consumed, as done by the connections.
+func (d *DefaultCommunication) publish(datagram Datagram) {
+	if d.configuration.Timeout <= 0 {
+		d.delivered(datagram, d.subscribers.Publish(d.ctx, datagram))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.configuration.Timeout)
+	defer cancel()
+	d.delivered(datagram, d.subscribers.Publish(ctx, datagram))
+}
+
+// Invoked after the received datagram is published or not to the consumer.
+func (d *DefaultCommunication) delivered(datagram Datagram, delivered bool) {
+	if !delivered {
+		// Accept the message when the sender tries again.
+		if d.deduplicator != nil {
+			d.deduplicator.forget(datagram.key())
+		}
+		return
+	}
+
+	if datagram.kind == KindReliable {
+		// A failed acknowledgement is recovered by the sender retrying.
+		datagram.connection.WriteFrame(Frame{Kind: KindAck, ID: datagram.id})
+	}
+}
+
 // Receive implements the Communication interface.
 func (d *DefaultCommunication) Receive() <-chan Datagram {
 	return d.listener.Consume()
 }
 
+// Statistics implements the Communication interface.
+func (d *DefaultCommunication) Statistics() PoolStatistics {
+	return d.pool.snapshot()
+}
+
+// IsAlive implements the Communication interface.
+func (d *DefaultCommunication) IsAlive(address Address) bool {
+	return d.detector.isAlive(address)
+}
+
+// PeerEvents implements the Communication interface.
+// Events are dropped when the channel is full, and the channel is
+// closed when the primitive closes.
+func (d *DefaultCommunication) PeerEvents() <-chan PeerEvent {
+	return d.detector.events
+}
+
+// ReceiveStatistics implements the Communication interface.
+func (d *DefaultCommunication) ReceiveStatistics() ReceiveStatistics {
+	return d.listener.Statistics()
+}
+
+// Subscribe implements the Communication interface.
+func (d *DefaultCommunication) Subscribe(filter Filter, policy ReceivePolicy) (*Subscription, error) {
+	if d.isClosed() {
+		return nil, ErrAlreadyClosed
+	}
+	return d.subscribers.subscribe(filter, policy)
+}
+
+// DropEvents implements the Communication interface.
+// Events are dropped when the channel is full, and the channel is
+// closed when the primitive closes.
+func (d *DefaultCommunication) DropEvents() <-chan DropEvent {
+	return d.drops.events
+}
+
 // Addr returns the current communication address.
 func (d *DefaultCommunication) Addr() net.Addr {
 	return d.transport.Addr()
@@ -0,0 +1,180 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBackoff        = 30 * time.Second
+	defaultBackoffMultiplier = 2.0
+)
+
+// ReconnectPolicy defines how long to wait before dialing again a peer
+// after failing to connect. While waiting, sending to the peer fails
+// immediately with ErrPeerBackoff. After the wait, a single send dials
+// the peer again, the others keep failing until it finishes. The wait
+// grows exponentially with each consecutive failure and is reset after
+// a successful connection.
+type ReconnectPolicy struct {
+	// Wait after the first failure.
+	// Zero disables the backoff, so every send dials again.
+	InitialBackoff time.Duration
+
+	// Maximum wait between attempts.
+	// Zero means a default of 30 seconds.
+	MaxBackoff time.Duration
+
+	// Growth of the wait after each consecutive failure.
+	// Zero means a default of 2.
+	Multiplier float64
+
+	// Fraction of the wait randomly added or removed, so peers failing
+	// together do not dial again at the same time. For example, 0.2
+	// waits between 80% and 120% of the computed wait.
+	Jitter float64
+}
+
+func (r ReconnectPolicy) maxBackoff() time.Duration {
+	if r.MaxBackoff <= 0 {
+		return defaultMaxBackoff
+	}
+	return r.MaxBackoff
+}
+
+func (r ReconnectPolicy) multiplier() float64 {
+	if r.Multiplier <= 0 {
+		return defaultBackoffMultiplier
+	}
+	return r.Multiplier
+}
+
+// The wait after the given amount of consecutive failures, before the jitter.
+func (r ReconnectPolicy) backoff(failures int) time.Duration {
+	backoff := float64(r.InitialBackoff)
+	limit := float64(r.maxBackoff())
+	for i := 1; i < failures && backoff < limit; i++ {
+		backoff *= r.multiplier()
+	}
+
+	if backoff > limit {
+		return r.maxBackoff()
+	}
+	return time.Duration(backoff)
+}
+
+// Consecutive connection failures to a peer.
+type dialFailures struct {
+	// Amount of consecutive failures.
+	count int
+
+	// When the peer can be dialed again.
+	retryAt time.Time
+
+	// Set while dialing again after the wait.
+	dialing bool
+}
+
+// Dials peers, waiting before dialing again peers that failed.
+type dialer struct {
+	// Synchronize the failures.
+	mutex *sync.Mutex
+
+	// How long to wait after failures.
+	policy ReconnectPolicy
+
+	// Source of the current time.
+	clock Clock
+
+	// Source of the jitter, guarded by the mutex.
+	random *rand.Rand
+
+	// Failures by the peer address.
+	failures map[Address]*dialFailures
+
+	// Establishes the connection, bounded by the timeout.
+	dial func(Address, time.Duration) (net.Conn, error)
+}
+
+func newDialer(policy ReconnectPolicy, clock Clock, dial func(Address, time.Duration) (net.Conn, error)) *dialer {
+	return &dialer{
+		mutex:    &sync.Mutex{},
+		policy:   policy,
+		clock:    clock,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		failures: make(map[Address]*dialFailures),
+		dial:     dial,
+	}
+}
+
+// Connect to the peer, unless it is still cooling down after failing.
+func (d *dialer) connect(address Address, timeout time.Duration) (net.Conn, error) {
+	if d.policy.InitialBackoff <= 0 {
+		return d.dial(address, timeout)
+	}
+
+	if !d.attempt(address) {
+		return nil, ErrPeerBackoff
+	}
+
+	conn, err := d.dial(address, timeout)
+	d.record(address, err)
+	return conn, err
+}
+
+// Verify if the peer can be dialed. Once the wait is over, only one
+// attempt is allowed until its result is recorded.
+func (d *dialer) attempt(address Address) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	failures, ok := d.failures[address]
+	if !ok {
+		return true
+	}
+
+	if failures.dialing || d.clock.Now().Before(failures.retryAt) {
+		return false
+	}
+	failures.dialing = true
+	return true
+}
+
+// Record the result of dialing the peer.
+func (d *dialer) record(address Address, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err == nil {
+		delete(d.failures, address)
+		return
+	}
+
+	failures, ok := d.failures[address]
+	if !ok {
+		failures = &dialFailures{}
+		d.failures[address] = failures
+	}
+	failures.count++
+	failures.dialing = false
+
+	backoff := float64(d.policy.backoff(failures.count))
+	if d.policy.Jitter > 0 {
+		backoff += backoff * d.policy.Jitter * (2*d.random.Float64() - 1)
+	}
+	failures.retryAt = d.clock.Now().Add(time.Duration(backoff))
+}
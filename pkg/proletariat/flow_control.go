@@ -0,0 +1,202 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// Amount of drop events buffered, newer events are dropped when full.
+	dropEventsBuffer = 128
+
+	// Header of the handshake frame holding the window of the sender.
+	flowWindowHeader = "window"
+)
+
+// FlowControlPolicy configures the credit-based flow control of each
+// connection. The sender spends a credit for every message, request or
+// reliable message written, and the receiver returns the credits after
+// handling them. When a connection has no credits left, the sender waits
+// until the receiver catches up, or fails with ErrReceiverBusy after
+// the configured Timeout.
+//
+// The window is advertised during the handshake, and the receiver
+// returns the credits based on the window of the sender. The peers can
+// use different windows, or have the flow control disabled.
+type FlowControlPolicy struct {
+	// Maximum messages written to a connection and not handled by the
+	// receiver yet. Zero disables the flow control.
+	Window int
+}
+
+func (f FlowControlPolicy) enabled() bool {
+	return f.Window > 0
+}
+
+// Credits are returned after handling half of the window, so the
+// sender is not waiting while the credits are sent.
+func (f FlowControlPolicy) threshold() int64 {
+	if f.Window < 2 {
+		return 1
+	}
+	return int64(f.Window / 2)
+}
+
+// Advertise the window in the handshake frame, so the peer returns
+// the credits spent.
+func (f FlowControlPolicy) advertise(frame Frame) Frame {
+	if f.enabled() {
+		window := make([]byte, 4)
+		binary.BigEndian.PutUint32(window, uint32(f.Window))
+		frame.Headers[flowWindowHeader] = window
+	}
+	return frame
+}
+
+// Read the window advertised by the peer in the handshake frame.
+// The flow control is disabled when nothing is advertised.
+func windowOf(frame Frame) FlowControlPolicy {
+	window := frame.Headers[flowWindowHeader]
+	if len(window) != 4 {
+		return FlowControlPolicy{}
+	}
+	return FlowControlPolicy{Window: int(binary.BigEndian.Uint32(window))}
+}
+
+// Verify if the frame spends a credit to be sent.
+func spendsCredit(kind FrameKind) bool {
+	return kind == KindMessage || kind == KindRequest || kind == KindReliable
+}
+
+// Credits available to send over a connection.
+type credits struct {
+	// Each element is a credit.
+	available chan struct{}
+}
+
+func newCredits(window int) *credits {
+	available := make(chan struct{}, window)
+	for i := 0; i < window; i++ {
+		available <- struct{}{}
+	}
+	return &credits{available: available}
+}
+
+// Wait for a credit, until the timeout expires, the connection is closed
+// or the context of the caller is done. Waits without a deadline when
+// the timeout is not greater than zero.
+func (c *credits) acquire(closed, ctx context.Context, timeout time.Duration) error {
+	select {
+	case <-c.available:
+		return nil
+	default:
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-c.available:
+		return nil
+	case <-expired:
+		return ErrReceiverBusy
+	case <-closed.Done():
+		return ErrAlreadyClosed
+	case <-ctx.Done():
+		if closed.Err() != nil {
+			return ErrAlreadyClosed
+		}
+		return ctx.Err()
+	}
+}
+
+// Add the credits returned by the receiver. Credits exceeding the
+// window are ignored.
+func (c *credits) grant(amount uint64) {
+	for i := uint64(0); i < amount; i++ {
+		select {
+		case c.available <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// DropEvent is published when a received message is dropped or evicted
+// because the Receive channel was full, according to the Receive policy.
+type DropEvent struct {
+	// Peer that sent the message.
+	From Address
+
+	// Identifier of the sending node, when advertised.
+	Node string
+
+	// Messages dropped since the primitive started, including this one.
+	Dropped uint64
+}
+
+// Counts the received messages dropped.
+type dropMonitor struct {
+	// Synchronize the counter and the channel.
+	mutex *sync.Mutex
+
+	// Flag to stop publishing events.
+	flag Flag
+
+	// Messages dropped.
+	dropped uint64
+
+	// Every message dropped.
+	events chan DropEvent
+}
+
+func newDropMonitor() *dropMonitor {
+	return &dropMonitor{
+		mutex:  &sync.Mutex{},
+		events: make(chan DropEvent, dropEventsBuffer),
+	}
+}
+
+// Count the datagram dropped, publishing the event without blocking.
+func (d *dropMonitor) record(datagram Datagram) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.flag.IsInactive() {
+		return
+	}
+
+	d.dropped++
+	select {
+	case d.events <- DropEvent{From: datagram.From, Node: datagram.Node, Dropped: d.dropped}:
+	default:
+	}
+}
+
+// Stop publishing events and close the channel.
+func (d *dropMonitor) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.flag.Inactivate() {
+		close(d.events)
+	}
+}
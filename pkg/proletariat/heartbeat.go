@@ -0,0 +1,281 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPhiThreshold    = 8.0
+	defaultHeartbeatWindow = 100
+
+	// Amount of events buffered, newer events are dropped when full.
+	peerEventsBuffer = 128
+)
+
+// HeartbeatPolicy configures the heartbeats sent to known peers and the
+// phi-accrual failure detector. A peer is known after a message is sent
+// to it or after it identifies itself on an incoming connection.
+//
+// Each heartbeat is a ping answered by the peer, the suspicion level
+// phi is computed from the distribution of the intervals between the
+// answers. A peer is considered down when phi reaches the threshold.
+type HeartbeatPolicy struct {
+	// Interval between pings to each peer.
+	// Zero disables the heartbeats.
+	Interval time.Duration
+
+	// Suspicion level to consider a peer down.
+	// Zero means a default of 8.
+	Threshold float64
+
+	// Amount of intervals used to estimate the distribution.
+	// Zero means a default of 100 intervals.
+	Window int
+
+	// Minimum standard deviation of the intervals, so small variations
+	// are not suspected when the intervals are steady.
+	// Zero means a default of a quarter of the interval.
+	MinDeviation time.Duration
+}
+
+func (h HeartbeatPolicy) threshold() float64 {
+	if h.Threshold <= 0 {
+		return defaultPhiThreshold
+	}
+	return h.Threshold
+}
+
+func (h HeartbeatPolicy) window() int {
+	if h.Window <= 0 {
+		return defaultHeartbeatWindow
+	}
+	return h.Window
+}
+
+func (h HeartbeatPolicy) minDeviation() time.Duration {
+	if h.MinDeviation <= 0 {
+		return h.Interval / 4
+	}
+	return h.MinDeviation
+}
+
+// PeerEvent notifies a change of the peer liveness.
+type PeerEvent struct {
+	// Address of the peer.
+	Address Address
+
+	// If the peer is now alive or down.
+	Alive bool
+}
+
+// Liveness of a single peer, from the intervals between heartbeats.
+type phiAccrual struct {
+	// Last intervals, used as a ring.
+	intervals []float64
+
+	// Position of the next interval in the ring.
+	next int
+
+	// When the last heartbeat arrived, zero if none arrived.
+	last time.Time
+
+	// If the peer was considered alive on the last verification.
+	alive bool
+
+	// Identifier of the ping waiting for an answer, zero if none.
+	ping uint64
+
+	// When the last ping was sent.
+	sent time.Time
+}
+
+// Record the heartbeat arrival.
+func (p *phiAccrual) heartbeat(now time.Time, policy HeartbeatPolicy) {
+	if p.last.IsZero() {
+		// Bootstrap the distribution with the expected interval.
+		p.add(float64(policy.Interval), policy.window())
+	} else {
+		p.add(float64(now.Sub(p.last)), policy.window())
+	}
+	p.last = now
+}
+
+func (p *phiAccrual) add(interval float64, window int) {
+	if len(p.intervals) < window {
+		p.intervals = append(p.intervals, interval)
+		return
+	}
+	p.intervals[p.next] = interval
+	p.next = (p.next + 1) % window
+}
+
+// The suspicion level of the peer being down. Uses the logistic
+// approximation of the normal cumulative distribution.
+func (p *phiAccrual) phi(now time.Time, policy HeartbeatPolicy) float64 {
+	if p.last.IsZero() {
+		return math.Inf(1)
+	}
+
+	var mean, variance float64
+	for _, interval := range p.intervals {
+		mean += interval
+	}
+	mean /= float64(len(p.intervals))
+	for _, interval := range p.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(p.intervals))
+	deviation := math.Max(math.Sqrt(variance), float64(policy.minDeviation()))
+
+	y := (float64(now.Sub(p.last)) - mean) / deviation
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Detects which known peers are alive.
+type failureDetector struct {
+	// Synchronize the peers.
+	mutex *sync.Mutex
+
+	// Flag to stop publishing events.
+	flag Flag
+
+	// How often and how strict peers are verified.
+	policy HeartbeatPolicy
+
+	// Known peers.
+	peers map[Address]*phiAccrual
+
+	// Address pinged, by the ping identifier.
+	pings map[uint64]Address
+
+	// Changes of the peers liveness.
+	events chan PeerEvent
+}
+
+func newFailureDetector(policy HeartbeatPolicy) *failureDetector {
+	return &failureDetector{
+		mutex:  &sync.Mutex{},
+		policy: policy,
+		peers:  make(map[Address]*phiAccrual),
+		pings:  make(map[uint64]Address),
+		events: make(chan PeerEvent, peerEventsBuffer),
+	}
+}
+
+// Start monitoring the peer, if not known yet.
+// Peers are not monitored when heartbeats are disabled.
+func (f *failureDetector) monitor(address Address) {
+	if f.policy.Interval <= 0 {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.peers[address]; !ok {
+		f.peers[address] = &phiAccrual{}
+	}
+}
+
+// Register a ping to each known peer that is not waiting for an answer.
+// Returns the identifier of each ping by the address.
+func (f *failureDetector) ping(identifier func() uint64) map[Address]uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	pings := make(map[Address]uint64)
+	for address, peer := range f.peers {
+		// An answer that never arrives is replaced after a while, since
+		// the connection used may have failed.
+		if _, waiting := f.pings[peer.ping]; waiting && time.Since(peer.sent) < 2*f.policy.Interval {
+			continue
+		}
+
+		delete(f.pings, peer.ping)
+		peer.sent = time.Now()
+		peer.ping = identifier()
+		f.pings[peer.ping] = address
+		pings[address] = peer.ping
+	}
+	return pings
+}
+
+// Record the answer of the ping with the given identifier.
+func (f *failureDetector) pong(id uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	address, ok := f.pings[id]
+	if !ok {
+		return
+	}
+	delete(f.pings, id)
+
+	peer := f.peers[address]
+	peer.ping = 0
+	peer.heartbeat(time.Now(), f.policy)
+	if !peer.alive {
+		peer.alive = true
+		f.publish(PeerEvent{Address: address, Alive: true})
+	}
+}
+
+// Verify every peer, publishing the ones that are now down.
+func (f *failureDetector) evaluate() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	for address, peer := range f.peers {
+		if peer.alive && peer.phi(now, f.policy) >= f.policy.threshold() {
+			peer.alive = false
+			f.publish(PeerEvent{Address: address, Alive: false})
+		}
+	}
+}
+
+// Verify if the peer is alive, unknown peers are not alive.
+func (f *failureDetector) isAlive(address Address) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	peer, ok := f.peers[address]
+	return ok && peer.phi(time.Now(), f.policy) < f.policy.threshold()
+}
+
+// Publish the event without blocking, dropping it if the buffer is full.
+// Must be called while holding the mutex.
+func (f *failureDetector) publish(event PeerEvent) {
+	if f.flag.IsInactive() {
+		return
+	}
+
+	select {
+	case f.events <- event:
+	default:
+	}
+}
+
+// Stop publishing events and close the channel.
+func (f *failureDetector) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.flag.Inactivate() {
+		close(f.events)
+	}
+}
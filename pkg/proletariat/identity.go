@@ -0,0 +1,90 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"net"
+)
+
+const (
+	// Headers of the handshake frame holding the identity.
+	identityAddressHeader = "address"
+	identityNodeHeader    = "node"
+)
+
+// Identity is how a peer identifies itself during the handshake,
+// instead of the ephemeral address of the connection.
+//
+// The advertised address is only trusted when it can be verified.
+// Over TCP, and TLS on top of it, the advertised host must resolve to
+// the IP the connection comes from, otherwise the connection address
+// is used instead. The port is not verified, since peers dial from
+// ephemeral ports. Addresses of other transports, such as the memory
+// ones, are trusted as advertised.
+type Identity struct {
+	// Address other peers use to reach the peer.
+	Address Address
+
+	// Optional identifier of the node.
+	Node string
+}
+
+// The handshake frame carrying the identity.
+func (i Identity) frame() Frame {
+	headers := map[string][]byte{identityAddressHeader: []byte(i.Address)}
+	if len(i.Node) > 0 {
+		headers[identityNodeHeader] = []byte(i.Node)
+	}
+	return Frame{Kind: KindHello, Headers: headers}
+}
+
+// Read the identity from the handshake frame.
+func identityOf(frame Frame) Identity {
+	return Identity{
+		Address: Address(frame.Headers[identityAddressHeader]),
+		Node:    string(frame.Headers[identityNodeHeader]),
+	}
+}
+
+// Verify if the identity can be trusted for a connection coming from
+// the remote address. Host names are resolved, bound by the context.
+func (i Identity) advertisedFrom(ctx context.Context, remote net.Addr) bool {
+	tcp, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(string(i.Address))
+	if err != nil || len(host) == 0 {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(tcp.IP)
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false
+	}
+
+	for _, address := range addresses {
+		if address.IP.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
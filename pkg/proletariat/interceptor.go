@@ -0,0 +1,75 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+// Message is the content of a message seen by the interceptors.
+type Message struct {
+	// Kind of the frame carrying the message. Changes are ignored.
+	Kind FrameKind
+
+	// Peer the message is sent to, or the peer that sent it when
+	// received. Changes are ignored.
+	Peer Address
+
+	// Metadata of the message, can be modified or replaced. This is
+	// a copy, never nil, so changes do not affect the sender's map.
+	Headers map[string][]byte
+
+	// Payload of the message, can be modified or replaced.
+	Data []byte
+}
+
+// Interceptor inspects a message sent or received, and can modify the
+// headers and payload in place. Returning an error rejects the message.
+type Interceptor func(*Message) error
+
+// Verify if the frame carries a message seen by the interceptors.
+// Frames used only by the protocol are not intercepted.
+func intercepts(kind FrameKind) bool {
+	switch kind {
+	case KindMessage, KindRequest, KindReply, KindReliable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Invoke the interceptors in order, stopping at the first rejecting
+// the message.
+func intercept(interceptors []Interceptor, message *Message) error {
+	for _, interceptor := range interceptors {
+		if err := interceptor(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the headers into a new map, so interceptors can modify it.
+func copyHeaders(headers map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(headers))
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Verify if both slices are the same, sharing the underlying array.
+func sameBytes(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
@@ -0,0 +1,214 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Amount of dialed connections waiting to be accepted.
+	memoryBacklog = 128
+)
+
+var (
+	errMemoryClosed  = errors.New(ClosedConnection)
+	errMemoryRefused = errors.New("connection refused")
+)
+
+// An address on the in-memory network.
+type memoryAddr string
+
+// Network implements the net.Addr interface.
+func (m memoryAddr) Network() string {
+	return "memory"
+}
+
+// String implements the net.Addr interface.
+func (m memoryAddr) String() string {
+	return string(m)
+}
+
+// A connection created by the in-memory network, reporting the
+// addresses of the transports instead of the pipe addresses.
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+// LocalAddr implements the net.Conn interface.
+func (m *memoryConn) LocalAddr() net.Addr {
+	return m.local
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (m *memoryConn) RemoteAddr() net.Addr {
+	return m.remote
+}
+
+// MemoryNetwork is a registry of named in-memory transports.
+// Transports created by the same network can dial each other, and
+// every connection is a synchronous in-memory pipe, so messages
+// never touch the network stack.
+type MemoryNetwork struct {
+	mutex *sync.Mutex
+
+	transports map[Address]*Memory
+}
+
+// NewMemoryNetwork creates a new empty network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		mutex:      &sync.Mutex{},
+		transports: make(map[Address]*Memory),
+	}
+}
+
+// NewTransport creates a new in-memory transport bound to the given name.
+// This method can be used as a TransportFactory.
+func (m *MemoryNetwork) NewTransport(_ context.Context, address Address) (Transport, error) {
+	if len(address) == 0 {
+		return nil, ErrInvalidAddr
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.transports[address]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	transport := &Memory{
+		mutex:    &sync.Mutex{},
+		network:  m,
+		addr:     memoryAddr(address),
+		incoming: make(chan net.Conn, memoryBacklog),
+		closed:   make(chan bool),
+	}
+	m.transports[address] = transport
+	return transport, nil
+}
+
+// Retrieve the transport bound to the given address.
+func (m *MemoryNetwork) lookup(address Address) *Memory {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.transports[address]
+}
+
+// Remove the transport, so the address can be bound again.
+func (m *MemoryNetwork) remove(transport *Memory) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.transports[Address(transport.addr)] == transport {
+		delete(m.transports, Address(transport.addr))
+	}
+}
+
+// A Memory transport that implements the Transport interface.
+// The transport is registered in a MemoryNetwork and only
+// transports in the same network can be reached.
+type Memory struct {
+	// Synchronize the backlog with closing.
+	mutex *sync.Mutex
+
+	// Network the transport is registered.
+	network *MemoryNetwork
+
+	// Address of the transport inside the network.
+	addr memoryAddr
+
+	// Connections dialed but not accepted yet.
+	incoming chan net.Conn
+
+	// Flag to transition to closed only once.
+	flag Flag
+
+	// Closed when the transport is closed.
+	closed chan bool
+}
+
+// Accept implement Transport interface.
+func (m *Memory) Accept() (net.Conn, error) {
+	select {
+	case <-m.closed:
+		return nil, &net.OpError{Op: "accept", Net: m.addr.Network(), Addr: m.addr, Err: errMemoryClosed}
+	case conn := <-m.incoming:
+		return conn, nil
+	}
+}
+
+// Close implement Transport interface.
+// Connections that were not accepted are closed as well.
+func (m *Memory) Close() error {
+	if m.flag.Inactivate() {
+		m.network.remove(m)
+		close(m.closed)
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		for {
+			select {
+			case conn := <-m.incoming:
+				conn.Close()
+			default:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Addr implement Transport interface.
+func (m *Memory) Addr() net.Addr {
+	return m.addr
+}
+
+// Dial implement Transport interface.
+// Connecting to a transport with a full backlog is refused.
+func (m *Memory) Dial(address Address, _ time.Duration) (net.Conn, error) {
+	target := m.network.lookup(address)
+	if target == nil {
+		return nil, &net.OpError{Op: "dial", Net: m.addr.Network(), Addr: memoryAddr(address), Err: errMemoryRefused}
+	}
+
+	client, server := net.Pipe()
+	if !target.enqueue(&memoryConn{Conn: server, local: target.addr, remote: m.addr}) {
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: m.addr.Network(), Addr: target.addr, Err: errMemoryRefused}
+	}
+	return &memoryConn{Conn: client, local: m.addr, remote: target.addr}, nil
+}
+
+// Add the connection to the backlog, if the transport is still open.
+func (m *Memory) enqueue(conn net.Conn) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.flag.IsInactive() {
+		return false
+	}
+
+	select {
+	case m.incoming <- conn:
+		return true
+	default:
+		return false
+	}
+}
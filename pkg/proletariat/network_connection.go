@@ -18,8 +18,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"github.com/ugorji/go/codec"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,7 +36,7 @@ type ConnectionConfiguration struct {
 	Timeout time.Duration
 
 	// Channel to publish the bytes received by the connection.
-	Read *SharedChannel
+	Read Publisher
 
 	// Parent context to bound the connection methods.
 	Ctx context.Context
@@ -48,125 +49,565 @@ type ConnectionConfiguration struct {
 
 	// Peer address of the connection.
 	Target Address
+
+	// Codec used to write and read frames.
+	// When not present, the MsgpackCodec is used.
+	Codec Codec
+
+	// Invoked for every received datagram before publishing to the
+	// Read channel. Returns `true` if the datagram was consumed and
+	// should not be published.
+	Handle func(Datagram) bool
+
+	// Invoked after trying to publish a datagram to the Read channel,
+	// with `true` if it was published. Datagrams without data are not
+	// published and are always considered delivered.
+	Delivered func(Datagram, bool)
+
+	// Identity sent to the peer during the handshake.
+	Identity Identity
+
+	// Invoked when the peer identity is received during the handshake.
+	// The address is empty when it could not be verified.
+	Identified func(Connection, Identity)
+
+	// Policy to gather messages written before flushing.
+	Batch BatchPolicy
+
+	// Credits limiting the messages written and not handled by the peer.
+	FlowControl FlowControlPolicy
+
+	// Interceptors invoked in order for every message received.
+	Inbound []Interceptor
 }
 
 // NetworkConnection is the default Connection implementation.
 // This will connect the peer to a target over the network.
 // Commands will be sent/received using the available Conn.
 type NetworkConnection struct {
+	// Synchronize concurrent writes.
+	mutex *sync.Mutex
+
 	// Target peer.
 	target Address
 
+	// Addresses of the underlying connection.
+	local  Address
+	remote Address
+
 	// Established connection with the target.
 	connection net.Conn
 
+	// Set when the identity is sent, accessed atomically.
+	greeted int32
+
+	// Identity received from the peer, only accessed while listening.
+	peer Identity
+
+	// Flow control of the peer, only accessed while listening. Credits
+	// are returned when the peer advertised a window.
+	peerFlow FlowControlPolicy
+
 	// Reader to receive data from the connection.
-	reader *bufio.Reader
+	reader *frameReader
 
 	// Writer to send data to the connection.
 	writer *bufio.Writer
 
+	// Flushes the pending batch after the linger, accessed
+	// while holding the mutex.
+	flusher   *time.Timer
+	scheduled bool
+	closed    bool
+
+	// Credits to write to the peer, nil if flow control is disabled.
+	credits *credits
+
+	// Credits to return to the peer, accessed atomically.
+	returning int64
+
+	// Spawns the goroutine writing the control frames.
+	handler *GoRoutineHandler
+
+	// Set while listening, accessed atomically. Control frames are
+	// only queued while listening.
+	listening int32
+
+	// Control frames waiting to be written, accessed while holding
+	// the control mutex.
+	controlMutex *sync.Mutex
+	control      []Frame
+
+	// Signals that control frames or credits are waiting.
+	signal chan struct{}
+
 	// Encodes all transported data.
-	encoder *codec.Encoder
+	encoder Encoder
 
 	// Decode received data.
-	decoder *codec.Decoder
+	decoder Decoder
 
 	// The configuration for the structure.
 	configuration ConnectionConfiguration
 }
 
 func NewNetworkConnection(configuration ConnectionConfiguration) Connection {
-	r, w := bufio.NewReader(configuration.Connection), bufio.NewWriter(configuration.Connection)
-	return &NetworkConnection{
+	w := bufio.NewWriter(configuration.Connection)
+	r := &frameReader{reader: bufio.NewReader(configuration.Connection), configuration: configuration}
+	if configuration.Batch.enabled() {
+		w = bufio.NewWriterSize(configuration.Connection, configuration.Batch.MaxSize)
+	}
+	var framing Codec = MsgpackCodec{}
+	if configuration.Codec != nil {
+		framing = configuration.Codec
+	}
+	connection := &NetworkConnection{
+		mutex:         &sync.Mutex{},
 		configuration: configuration,
 		target:        configuration.Target,
+		local:         Address(configuration.Connection.LocalAddr().String()),
+		remote:        Address(configuration.Connection.RemoteAddr().String()),
 		connection:    configuration.Connection,
 		reader:        r,
 		writer:        w,
-		encoder:       codec.NewEncoder(w, &codec.MsgpackHandle{}),
-		decoder:       codec.NewDecoder(r, &codec.MsgpackHandle{}),
+		encoder:       framing.NewEncoder(w),
+		decoder:       framing.NewDecoder(r),
+		handler:       NewRoutineHandler(),
+		controlMutex:  &sync.Mutex{},
+		signal:        make(chan struct{}, 1),
+	}
+	if configuration.FlowControl.enabled() {
+		connection.credits = newCredits(configuration.FlowControl.Window)
+	}
+	return connection
+}
+
+// Handle the received frame, publishing it if not consumed.
+// Returns the kind of the frame.
+func (n *NetworkConnection) receive(frame Frame) FrameKind {
+	datagram := n.newDatagram(frame)
+	if err := n.intercept(&datagram); err != nil {
+		n.reject(datagram, err)
+		return frame.Kind
+	}
+
+	if n.configuration.Handle != nil && n.configuration.Handle(datagram) {
+		return frame.Kind
+	}
+
+	delivered := frame.Data == nil || n.deliverDatagram(datagram)
+	if n.configuration.Delivered != nil {
+		n.configuration.Delivered(datagram, delivered)
+	}
+	return frame.Kind
+}
+
+// Invoke the inbound interceptors with the datagram content, updating
+// the datagram with the content modified by the interceptors.
+func (n *NetworkConnection) intercept(datagram *Datagram) error {
+	if len(n.configuration.Inbound) == 0 || !intercepts(datagram.kind) {
+		return nil
+	}
+
+	message := &Message{Kind: datagram.kind, Peer: datagram.From, Headers: copyHeaders(datagram.Headers), Data: datagram.Data.Bytes()}
+	if err := intercept(n.configuration.Inbound, message); err != nil {
+		return err
+	}
+
+	// A replaced payload is not held by the pooled buffer anymore,
+	// which is left to be collected since the payload can share it.
+	datagram.Headers = message.Headers
+	if !sameBytes(message.Data, datagram.Data.Bytes()) {
+		datagram.Data = bytes.NewBuffer(message.Data)
+		datagram.pooled = false
+	}
+	return nil
+}
+
+// Discard the datagram rejected by an interceptor. Requests fail with
+// the error, and reliable messages are acknowledged so they are not
+// sent again.
+func (n *NetworkConnection) reject(datagram Datagram, err error) {
+	switch datagram.kind {
+	case KindRequest:
+		headers := map[string][]byte{replyErrorHeader: []byte(err.Error())}
+		n.enqueue(Frame{Kind: KindReply, ID: datagram.id, Headers: headers})
+	case KindReliable:
+		n.enqueue(Frame{Kind: KindAck, ID: datagram.id})
+	}
+	datagram.Release()
+}
+
+// Count a credit to return to the peer after handling the frame,
+// signaling once enough credits are waiting.
+func (n *NetworkConnection) handled(kind FrameKind) {
+	if !n.peerFlow.enabled() || !spendsCredit(kind) {
+		return
+	}
+
+	if atomic.AddInt64(&n.returning, 1) >= n.peerFlow.threshold() {
+		n.notify()
+	}
+}
+
+// Queue the control frame to be written apart from listening.
+func (n *NetworkConnection) enqueue(frame Frame) {
+	n.controlMutex.Lock()
+	n.control = append(n.control, frame)
+	n.controlMutex.Unlock()
+	n.notify()
+}
+
+// Signal the control writer without blocking.
+func (n *NetworkConnection) notify() {
+	select {
+	case n.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Write the queued control frames and the credits to return, until
+// stopped. Control frames are written apart from listening, so peers
+// sharing a connection are not waiting on each other to read while
+// both are answering at the same time.
+func (n *NetworkConnection) writeControl(stop <-chan struct{}) func() {
+	return func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-n.signal:
+			}
+
+			n.controlMutex.Lock()
+			frames := n.control
+			n.control = nil
+			n.controlMutex.Unlock()
+
+			if amount := atomic.SwapInt64(&n.returning, 0); amount > 0 {
+				frames = append(frames, Frame{Kind: KindCredit, ID: uint64(amount)})
+			}
+
+			for _, frame := range frames {
+				if err := n.writeFrame(frame); err != nil {
+					return
+				}
+			}
+		}
 	}
 }
 
 // Delivers a message back through the read channel.
 // If no timeout is configured, this will be locked here until the
 // channel is consumed or the connection is closed.
-func (n *NetworkConnection) deliverDatagram(datagram Datagram) {
+// Returns `true` if the message was published.
+func (n *NetworkConnection) deliverDatagram(datagram Datagram) bool {
 	if n.configuration.Timeout <= 0 {
-		n.configuration.Read.Publish(n.configuration.Ctx, datagram)
-		return
+		return n.configuration.Read.Publish(n.configuration.Ctx, datagram)
 	}
 
 	ctx, cancel := context.WithTimeout(n.configuration.Ctx, n.configuration.Timeout)
 	defer cancel()
-	n.configuration.Read.Publish(ctx, datagram)
+	return n.configuration.Read.Publish(ctx, datagram)
 }
 
-// Read data from the reader. The default buffer will have size 1 Kb.
-// With this size, is possible that a message can be split in more than
-// one buffer. The client must be careful when parsing the received bytes.
-func (n *NetworkConnection) digest() ([]byte, error) {
+// Read the next frame from the reader, using the configured codec.
+func (n *NetworkConnection) digest() (Frame, error) {
 	if n.configuration.Timeout > 0 {
 		if err := n.connection.SetReadDeadline(time.Now().Add(n.configuration.Timeout)); err != nil {
-			return nil, err
+			return Frame{}, err
 		}
 	}
+	n.reader.read = 0
+	return n.decoder.Decode()
+}
+
+// Reads the frames from the connection. When the deadline expires after
+// the frame started, the bytes already read can not be returned to the
+// connection, so the reader waits for the rest of the frame instead of
+// failing, until the connection context is done.
+type frameReader struct {
+	reader *bufio.Reader
+
+	// Bytes read since the current frame started.
+	read int
+
+	// The configuration of the connection.
+	configuration ConnectionConfiguration
+}
+
+// Read implements the io.Reader interface.
+func (f *frameReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.reader.Read(p)
+		f.read += n
+		if err == nil || !f.resume(err) {
+			return n, err
+		}
 
-	// Decoding into a nil interface will delegate to the
-	// decoder to correctly identify and construct the object.
-	// In our case, a byte slice.
-	var data interface{}
-	if err := n.decoder.Decode(&data); err != nil {
-		return nil, err
+		if n > 0 {
+			return n, nil
+		}
 	}
+}
+
+// ReadByte implements the io.ByteReader interface.
+func (f *frameReader) ReadByte() (byte, error) {
+	for {
+		b, err := f.reader.ReadByte()
+		if err == nil {
+			f.read++
+			return b, nil
+		}
 
-	if data == nil {
-		return nil, nil
+		if !f.resume(err) {
+			return b, err
+		}
 	}
+}
 
-	return data.([]byte), nil
+// UnreadByte implements the io.ByteScanner interface.
+func (f *frameReader) UnreadByte() error {
+	if err := f.reader.UnreadByte(); err != nil {
+		return err
+	}
+	f.read--
+	return nil
+}
+
+// Verify if reading should continue after the error, extending
+// the deadline when the frame already started.
+func (f *frameReader) resume(err error) bool {
+	if f.read == 0 || !isTimeout(err) || f.configuration.Ctx.Err() != nil {
+		return false
+	}
+	return f.configuration.Connection.SetReadDeadline(time.Now().Add(f.configuration.Timeout)) == nil
 }
 
 // Close implements the Connection interface.
 func (n *NetworkConnection) Close() error {
+	if n.configuration.Batch.enabled() {
+		// Bounds a write blocked while holding the lock, so the
+		// pending batch is flushed before closing. The connection
+		// is still read meanwhile, since the peer may be waiting
+		// for a frame to be read before reading the batch.
+		_ = n.connection.SetWriteDeadline(time.Now().Add(batchCloseTimeout))
+		n.mutex.Lock()
+		n.closed = true
+		if n.flusher != nil {
+			n.flusher.Stop()
+		}
+		_ = n.writer.Flush()
+		n.mutex.Unlock()
+	}
 	n.configuration.Cancel()
 	return n.connection.Close()
 }
 
-// Implements the Connection interface.
+// Handshake implements the Connection interface.
+// The identity and the window are sent only once, either when the handshake starts or
+// when answering the peer.
+func (n *NetworkConnection) Handshake() error {
+	if atomic.CompareAndSwapInt32(&n.greeted, 0, 1) {
+		return n.WriteFrame(n.configuration.FlowControl.advertise(n.configuration.Identity.frame()))
+	}
+	return nil
+}
+
+// Write implements the Connection interface.
 func (n *NetworkConnection) Write(bytes []byte) error {
+	return n.WriteFrame(Frame{Data: bytes})
+}
+
+// WriteFrame implements the Connection interface.
+func (n *NetworkConnection) WriteFrame(frame Frame) error {
+	return n.WriteFrameContext(n.configuration.Ctx, frame)
+}
+
+// WriteFrameContext implements the Connection interface.
+// The context bounds the wait for credits.
+func (n *NetworkConnection) WriteFrameContext(ctx context.Context, frame Frame) error {
+	if answersPeer(frame.Kind) && atomic.LoadInt32(&n.listening) == 1 {
+		n.enqueue(frame)
+		return nil
+	}
+
+	if n.credits == nil || !spendsCredit(frame.Kind) {
+		return n.writeFrame(frame)
+	}
+
+	if err := n.credits.acquire(n.configuration.Ctx, ctx, n.configuration.Timeout); err != nil {
+		return err
+	}
+
+	// The credit is not spent if the frame is not written.
+	err := n.writeFrame(frame)
+	if err != nil {
+		n.credits.grant(1)
+	}
+	return err
+}
+
+// Write the frame, flushing unless it is batched.
+func (n *NetworkConnection) writeFrame(frame Frame) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 	if n.configuration.Timeout > 0 {
 		if err := n.connection.SetWriteDeadline(time.Now().Add(n.configuration.Timeout)); err != nil {
 			return err
 		}
 	}
 
-	if err := n.encoder.Encode(bytes); err != nil {
+	if n.closed {
+		return ErrAlreadyClosed
+	}
+
+	if err := n.encoder.Encode(frame); err != nil {
 		return err
 	}
 
+	if frame.Kind == KindMessage && n.configuration.Batch.enabled() {
+		n.schedule()
+		return nil
+	}
 	return n.writer.Flush()
 }
 
+// Schedule the flush of the pending batch after the linger.
+// Must be called while holding the lock.
+func (n *NetworkConnection) schedule() {
+	if n.scheduled {
+		return
+	}
+
+	n.scheduled = true
+	if n.flusher == nil {
+		n.flusher = time.AfterFunc(n.configuration.Batch.linger(), n.flush)
+		return
+	}
+	n.flusher.Reset(n.configuration.Batch.linger())
+}
+
+// Flush the pending batch, closing the connection if it fails.
+func (n *NetworkConnection) flush() {
+	n.mutex.Lock()
+	n.scheduled = false
+	if n.closed || n.writer.Buffered() == 0 {
+		n.mutex.Unlock()
+		return
+	}
+
+	var err error
+	if n.configuration.Timeout > 0 {
+		err = n.connection.SetWriteDeadline(time.Now().Add(n.configuration.Timeout))
+	}
+	if err == nil {
+		err = n.writer.Flush()
+	}
+	n.mutex.Unlock()
+
+	if err != nil {
+		n.Close()
+	}
+}
+
 // Listen implements the Connection interface.
-// Digest bytes received from the underlining connection.
+// Digest frames received from the underlining connection. Listening
+// stops when the connection fails, since after an error the framing
+// can not be recovered; timeouts are not considered failures.
+// The connection is closed after listening stops.
 func (n *NetworkConnection) Listen() {
+	stop := make(chan struct{})
+	if n.handler.TrySpawn(n.writeControl(stop)) {
+		atomic.StoreInt32(&n.listening, 1)
+	}
+	defer func() {
+		atomic.StoreInt32(&n.listening, 0)
+		close(stop)
+
+		// Closing unblocks the control writer waiting on the peer.
+		n.Close()
+		n.handler.Close()
+	}()
+
 	for {
 		select {
 		case <-n.configuration.Ctx.Done():
 			return
 		default:
-			data, err := n.digest()
-			if data != nil {
-				datagram := Datagram{
-					Data: bytes.NewBuffer(data),
-					Err:  err,
-					From: Address(n.connection.RemoteAddr().String()),
-					To:   Address(n.connection.LocalAddr().String()),
+			frame, err := n.digest()
+			if err != nil {
+				if isTimeout(err) {
+					continue
 				}
-				n.deliverDatagram(datagram)
+				return
 			}
+
+			if frame.Kind == KindHello {
+				n.peer = identityOf(frame)
+				n.peerFlow = windowOf(frame)
+				if !n.peer.advertisedFrom(n.configuration.Ctx, n.configuration.Connection.RemoteAddr()) {
+					n.peer.Address = ""
+				}
+				if frame.buffer != nil {
+					releaseBuffer(frame.buffer)
+				}
+				if err = n.Handshake(); err != nil {
+					return
+				}
+				if n.configuration.Identified != nil {
+					n.configuration.Identified(n, n.peer)
+				}
+				continue
+			}
+
+			if frame.Kind == KindCredit {
+				if n.credits != nil {
+					n.credits.grant(frame.ID)
+				}
+				if frame.buffer != nil {
+					releaseBuffer(frame.buffer)
+				}
+				continue
+			}
+
+			n.handled(n.receive(frame))
 		}
 	}
 }
+
+// Verify if the frame answers a frame received from the peer, so it
+// is written apart from listening.
+func answersPeer(kind FrameKind) bool {
+	return kind == KindAck || kind == KindPong
+}
+
+// Wrap the received frame into a datagram.
+func (n *NetworkConnection) newDatagram(frame Frame) Datagram {
+	datagram := Datagram{
+		Data:       frame.buffer,
+		Headers:    frame.Headers,
+		From:       n.remote,
+		Node:       n.peer.Node,
+		To:         n.local,
+		pooled:     frame.buffer != nil,
+		kind:       frame.Kind,
+		id:         frame.ID,
+		origin:     frame.Origin,
+		sequence:   frame.Sequence,
+		connection: n,
+	}
+	if datagram.Data == nil {
+		datagram.Data = bytes.NewBuffer(frame.Data)
+	}
+	if len(n.peer.Address) > 0 {
+		datagram.From = n.peer.Address
+	}
+	return datagram
+}
+
+// Verify if the error was caused by an expired deadline.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
@@ -0,0 +1,256 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReorderTimeout  = time.Second
+	defaultReorderCapacity = 1024
+	defaultReorderSenders  = 1024
+)
+
+// ReorderPolicy defines how the receiver waits for messages that
+// arrive out of order. A message that arrives after the receiver
+// stopped waiting for it is discarded.
+type ReorderPolicy struct {
+	// Time to wait for a missing message before delivering the
+	// ones after it. Zero means a default of 1 second.
+	Timeout time.Duration
+
+	// Maximum amount of messages waiting for a missing message, for
+	// each sender. When exceeded, the missing messages are skipped.
+	// Zero means a default of 1024 messages.
+	Capacity int
+
+	// Maximum amount of senders remembered. When exceeded, the senders
+	// without pending messages that received nothing for longer are
+	// forgotten first. A forgotten sender that sends again has its
+	// message wait for the timeout. Zero means a default of 1024 senders.
+	Senders int
+}
+
+func (r ReorderPolicy) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultReorderTimeout
+	}
+	return r.Timeout
+}
+
+func (r ReorderPolicy) capacity() int {
+	if r.Capacity <= 0 {
+		return defaultReorderCapacity
+	}
+	return r.Capacity
+}
+
+func (r ReorderPolicy) senders() int {
+	if r.Senders <= 0 {
+		return defaultReorderSenders
+	}
+	return r.Senders
+}
+
+// The ordered messages sent to a single destination.
+type sendSequence struct {
+	// Sequence of the last message sent, accessed atomically.
+	last uint64
+}
+
+// The sequence for the next message sent.
+func (s *sendSequence) next() uint64 {
+	return atomic.AddUint64(&s.last, 1)
+}
+
+// The messages received from a single sender instance.
+type stream struct {
+	// Sequence of the next message to deliver.
+	next uint64
+
+	// Messages waiting for the missing ones, by sequence.
+	pending map[uint64]Datagram
+
+	// Expires the wait for the missing message, nil if nothing is pending.
+	timer *time.Timer
+
+	// Sequence of the missing message the timer is waiting.
+	waiting uint64
+
+	// Position of the sender in the recently received.
+	element *list.Element
+}
+
+// Delivers the received messages in the order they were sent by
+// each sender, independent of the connection they were received.
+type sequencer struct {
+	// Synchronize the streams, held while delivering so
+	// messages of a stream are not delivered concurrently.
+	mutex *sync.Mutex
+
+	// Flag to stop waiting for missing messages.
+	flag Flag
+
+	// How long and how many messages are waited.
+	policy ReorderPolicy
+
+	// Streams by the sender instance.
+	streams map[uint64]*stream
+
+	// Sender instances, from the least to the most recently received.
+	recent *list.List
+
+	// Delivers the message to the consumer.
+	deliver func(Datagram)
+}
+
+func newSequencer(policy ReorderPolicy, deliver func(Datagram)) *sequencer {
+	return &sequencer{
+		mutex:   &sync.Mutex{},
+		policy:  policy,
+		streams: make(map[uint64]*stream),
+		recent:  list.New(),
+		deliver: deliver,
+	}
+}
+
+// Receive the datagram, delivering it and the following ones waiting
+// when it is the next in the sequence of the sender.
+// Returns `false` if the datagram was already delivered or skipped.
+func (s *sequencer) receive(datagram Datagram) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.streams[datagram.origin]
+	if !ok {
+		current = &stream{next: 1, pending: make(map[uint64]Datagram)}
+		current.element = s.recent.PushBack(datagram.origin)
+		s.streams[datagram.origin] = current
+		s.evict(current)
+	} else {
+		s.recent.MoveToBack(current.element)
+	}
+
+	if _, ok := current.pending[datagram.sequence]; ok || datagram.sequence < current.next {
+		return false
+	}
+
+	current.pending[datagram.sequence] = datagram
+	s.flush(current)
+	for len(current.pending) > s.policy.capacity() {
+		s.skip(current)
+	}
+	s.schedule(current)
+	return true
+}
+
+// Forget the least recently received senders while exceeding the limit.
+// Senders waiting for missing messages are kept.
+func (s *sequencer) evict(current *stream) {
+	for element := s.recent.Front(); element != nil && len(s.streams) > s.policy.senders(); {
+		next := element.Next()
+		origin := element.Value.(uint64)
+		if candidate := s.streams[origin]; candidate != current && len(candidate.pending) == 0 {
+			s.recent.Remove(element)
+			delete(s.streams, origin)
+		}
+		element = next
+	}
+}
+
+// Deliver the messages from the next in the sequence, until one is missing.
+// Skipped sequences are passed over without delivering.
+func (s *sequencer) flush(current *stream) {
+	for {
+		datagram, ok := current.pending[current.next]
+		if !ok {
+			return
+		}
+		delete(current.pending, current.next)
+		current.next++
+		if datagram.kind == KindSkip {
+			datagram.Release()
+			continue
+		}
+		s.deliver(datagram)
+	}
+}
+
+// Stop waiting for the missing messages, delivering from the lowest waiting.
+func (s *sequencer) skip(current *stream) {
+	lowest := uint64(0)
+	for sequence := range current.pending {
+		if lowest == 0 || sequence < lowest {
+			lowest = sequence
+		}
+	}
+
+	if lowest > 0 {
+		current.next = lowest
+		s.flush(current)
+	}
+}
+
+// Wait for the missing message while messages are pending.
+// The timer restarts when the next missing message changes.
+func (s *sequencer) schedule(current *stream) {
+	if current.timer != nil && (len(current.pending) == 0 || current.waiting != current.next) {
+		current.timer.Stop()
+		current.timer = nil
+	}
+
+	if current.timer == nil && len(current.pending) > 0 {
+		waiting := current.next
+		current.waiting = waiting
+		current.timer = time.AfterFunc(s.policy.timeout(), func() {
+			s.expire(current, waiting)
+		})
+	}
+}
+
+// Invoked when the wait for the missing message expires. Does nothing
+// if the message arrived while the timer was firing.
+func (s *sequencer) expire(current *stream, waiting uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.flag.IsInactive() || current.next != waiting {
+		return
+	}
+
+	current.timer = nil
+	s.skip(current)
+	s.schedule(current)
+}
+
+// Stop waiting for missing messages, the pending ones are released.
+func (s *sequencer) close() {
+	if s.flag.Inactivate() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for origin, current := range s.streams {
+			if current.timer != nil {
+				current.timer.Stop()
+			}
+			for _, datagram := range current.pending {
+				datagram.Release()
+			}
+			delete(s.streams, origin)
+		}
+		s.recent.Init()
+	}
+}
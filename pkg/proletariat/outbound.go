@@ -0,0 +1,237 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueSize        = 1024
+	defaultQueueWriters     = 1
+	defaultQueueIdleTimeout = time.Minute
+)
+
+// QueuePolicy defines what happens when sending to a full queue.
+type QueuePolicy uint8
+
+const (
+	// QueueBlock waits until the queue has space.
+	QueueBlock QueuePolicy = iota
+
+	// QueueDropOldest removes the oldest queued message, which
+	// fails with ErrMessageDropped, to enqueue the new one.
+	QueueDropOldest
+
+	// QueueError fails the new message with ErrQueueFull.
+	QueueError
+)
+
+// AsyncPolicy configures the queues used by SendAsync.
+// Each peer has its own queue, served by its own writer goroutines,
+// which are removed after the queue is idle.
+type AsyncPolicy struct {
+	// Maximum messages queued for each peer.
+	// Zero means a default of 1024 messages.
+	QueueSize int
+
+	// Goroutines writing the messages of each peer. With more than
+	// one writer, messages may be sent out of order.
+	// Zero means a default of 1 writer.
+	Writers int
+
+	// What happens when the queue is full.
+	Full QueuePolicy
+
+	// Time the queue of a peer is kept without messages, after which
+	// its writers stop. Zero means a default of 1 minute.
+	IdleTimeout time.Duration
+}
+
+func (a AsyncPolicy) queueSize() int {
+	if a.QueueSize <= 0 {
+		return defaultQueueSize
+	}
+	return a.QueueSize
+}
+
+func (a AsyncPolicy) writers() int {
+	if a.Writers <= 0 {
+		return defaultQueueWriters
+	}
+	return a.Writers
+}
+
+func (a AsyncPolicy) idleTimeout() time.Duration {
+	if a.IdleTimeout <= 0 {
+		return defaultQueueIdleTimeout
+	}
+	return a.IdleTimeout
+}
+
+// A message waiting to be sent.
+type outboundMessage struct {
+	data []byte
+
+	// Receives the result of sending.
+	result chan error
+}
+
+// Complete the message with the result.
+func (o outboundMessage) complete(err error) {
+	o.result <- err
+}
+
+// The messages waiting to be sent to a peer.
+type outboundQueue struct {
+	// Messages in the order they are sent.
+	messages chan outboundMessage
+
+	// Senders adding a message, accessed while holding the
+	// mutex of the queues. The queue is not removed while adding.
+	enqueuing int
+
+	// Closed when the queue is removed, stopping the writers.
+	stopped chan struct{}
+}
+
+// Queues of messages waiting to be sent, by peer.
+type outboundQueues struct {
+	// Synchronize the creation and removal of queues.
+	mutex *sync.Mutex
+
+	// How queues are sized and served.
+	policy AsyncPolicy
+
+	// Queues by the peer address.
+	queues map[Address]*outboundQueue
+
+	// Starts the writers of a new queue, returns `false` if not possible.
+	serve func(Address, *outboundQueue) bool
+}
+
+func newOutboundQueues(policy AsyncPolicy, serve func(Address, *outboundQueue) bool) *outboundQueues {
+	return &outboundQueues{
+		mutex:  &sync.Mutex{},
+		policy: policy,
+		queues: make(map[Address]*outboundQueue),
+		serve:  serve,
+	}
+}
+
+// Retrieve the queue of the peer, creating it if needed. The queue is
+// kept while adding the message, until released.
+// Returns nil if the writers could not be started.
+func (o *outboundQueues) acquire(address Address) *outboundQueue {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	queue, ok := o.queues[address]
+	if !ok {
+		queue = &outboundQueue{
+			messages: make(chan outboundMessage, o.policy.queueSize()),
+			stopped:  make(chan struct{}),
+		}
+		if !o.serve(address, queue) {
+			return nil
+		}
+		o.queues[address] = queue
+	}
+	queue.enqueuing++
+	return queue
+}
+
+// Release the queue after adding the message.
+func (o *outboundQueues) release(queue *outboundQueue) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	queue.enqueuing--
+}
+
+// Remove the idle queue of the peer, stopping its writers.
+// Does nothing if a message is queued or being added.
+func (o *outboundQueues) retire(address Address, queue *outboundQueue) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.queues[address] != queue || queue.enqueuing > 0 || len(queue.messages) > 0 {
+		return
+	}
+	delete(o.queues, address)
+	close(queue.stopped)
+}
+
+// Add the message to the queue of the peer, following the policy
+// when the queue is full. The message is completed if not queued.
+func (o *outboundQueues) enqueue(ctx context.Context, address Address, message outboundMessage) {
+	queue := o.acquire(address)
+	if queue == nil {
+		message.complete(ErrAlreadyClosed)
+		return
+	}
+	defer o.release(queue)
+
+	o.push(ctx, queue.messages, message)
+
+	// Writers stop when closed, so messages queued while closing are completed here.
+	if ctx.Err() != nil {
+		drainOutbound(queue.messages, ErrAlreadyClosed)
+	}
+}
+
+func (o *outboundQueues) push(ctx context.Context, queue chan outboundMessage, message outboundMessage) {
+	for {
+		if ctx.Err() != nil {
+			message.complete(ErrAlreadyClosed)
+			return
+		}
+
+		select {
+		case queue <- message:
+			return
+		default:
+		}
+
+		switch o.policy.Full {
+		case QueueError:
+			message.complete(ErrQueueFull)
+			return
+		case QueueDropOldest:
+			select {
+			case oldest := <-queue:
+				oldest.complete(ErrMessageDropped)
+			default:
+			}
+		default:
+			select {
+			case <-ctx.Done():
+			case queue <- message:
+				return
+			}
+		}
+	}
+}
+
+// Complete the messages left in the queue, without sending.
+func drainOutbound(queue chan outboundMessage, err error) {
+	for {
+		select {
+		case message := <-queue:
+			message.complete(err)
+		default:
+			return
+		}
+	}
+}
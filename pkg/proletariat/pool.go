@@ -0,0 +1,287 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"sync"
+	"time"
+)
+
+// PoolPolicy defines how long connections are kept in the pool.
+// Connections exceeding the limits are closed by a background reaper,
+// or when they would be used to send a message.
+type PoolPolicy struct {
+	// Time a connection can remain unused in the pool.
+	// Zero means connections are never closed for being idle.
+	IdleTimeout time.Duration
+
+	// Maximum time a connection is used since established.
+	// Zero means connections have no maximum lifetime.
+	MaxLifetime time.Duration
+
+	// Interval between verifications of the pooled connections.
+	// Zero means half of the smallest limit configured.
+	ReapInterval time.Duration
+}
+
+// Verify if any limit is configured.
+func (p PoolPolicy) enabled() bool {
+	return p.IdleTimeout > 0 || p.MaxLifetime > 0
+}
+
+func (p PoolPolicy) reapInterval() time.Duration {
+	if p.ReapInterval > 0 {
+		return p.ReapInterval
+	}
+
+	interval := p.IdleTimeout
+	if interval <= 0 || (p.MaxLifetime > 0 && p.MaxLifetime < interval) {
+		interval = p.MaxLifetime
+	}
+	return interval / 2
+}
+
+// PoolStatistics is a snapshot of the connections of a Communication.
+type PoolStatistics struct {
+	// Connections currently open, including the ones in use.
+	Open int
+
+	// Connections waiting in the pool to be used.
+	Idle int
+
+	// Connections dialed to other peers.
+	Dialed uint64
+
+	// Connections accepted from other peers.
+	Accepted uint64
+
+	// Times a pooled connection was used instead of dialing.
+	Reused uint64
+
+	// Connections closed for being idle for too long.
+	IdleClosed uint64
+
+	// Connections closed for exceeding the maximum lifetime.
+	Expired uint64
+}
+
+// A connection waiting in the pool.
+type pooledConnection struct {
+	connection Connection
+
+	// When the connection was returned to the pool.
+	since time.Time
+}
+
+// Holds the open connections and the ones available to send messages.
+type connectionPool struct {
+	// Synchronize operations on the connections.
+	mutex *sync.Mutex
+
+	// Set when the pool is closed, no connections are accepted after.
+	closed bool
+
+	// Maximum connections available for each address, zero is unlimited.
+	size int
+
+	// Limits for the pooled connections.
+	policy PoolPolicy
+
+	// Connections available to send messages, by address.
+	available map[Address][]pooledConnection
+
+	// All open connections, including the ones in use and the
+	// ones only receiving messages, with the time established.
+	established map[Connection]time.Time
+
+	// Counters of the pool life-cycle.
+	statistics PoolStatistics
+}
+
+func newConnectionPool(size int, policy PoolPolicy) *connectionPool {
+	return &connectionPool{
+		mutex:       &sync.Mutex{},
+		size:        size,
+		policy:      policy,
+		available:   make(map[Address][]pooledConnection),
+		established: make(map[Connection]time.Time),
+	}
+}
+
+// Keep track of the open connection, so it is closed with the pool.
+// Returns `false` if the pool is already closed.
+func (p *connectionPool) track(connection Connection, incoming bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+
+	p.established[connection] = time.Now()
+	if incoming {
+		p.statistics.Accepted++
+	} else {
+		p.statistics.Dialed++
+	}
+	return true
+}
+
+// Retrieve an available connection to the address, nil if there is none.
+// Connections exceeding the limits are closed instead.
+func (p *connectionPool) acquire(address Address) Connection {
+	var expired []Connection
+	defer func() { closeAll(expired) }()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	connections := p.available[address]
+	for size := len(connections); size > 0; size = len(connections) {
+		pooled := connections[size-1]
+		connections[size-1] = pooledConnection{}
+		connections = connections[:size-1]
+		p.available[address] = connections
+		if p.evict(pooled, now) {
+			expired = append(expired, pooled.connection)
+			continue
+		}
+
+		p.statistics.Reused++
+		return pooled.connection
+	}
+	return nil
+}
+
+// Store the connection to be reused, if the pool is not full and the
+// connection did not exceed its lifetime.
+// Returns `false` if the connection was not stored.
+func (p *connectionPool) release(address Address, connection Connection) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	established, ok := p.established[connection]
+	if p.closed || !ok {
+		return false
+	}
+
+	now := time.Now()
+	if p.policy.MaxLifetime > 0 && now.Sub(established) >= p.policy.MaxLifetime {
+		p.statistics.Expired++
+		delete(p.established, connection)
+		return false
+	}
+
+	available := p.available[address]
+	if p.size > 0 && len(available) > p.size {
+		return false
+	}
+	p.available[address] = append(available, pooledConnection{connection: connection, since: now})
+	return true
+}
+
+// Remove the connection from the pool and stop tracking it.
+func (p *connectionPool) forget(connection Connection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.established, connection)
+	for address, connections := range p.available {
+		for i, pooled := range connections {
+			if pooled.connection == connection {
+				p.available[address] = append(connections[:i], connections[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Verify if the pooled connection exceeded a limit, counting it.
+// Evicted connections are not tracked anymore.
+// Must be called while holding the mutex.
+func (p *connectionPool) evict(pooled pooledConnection, now time.Time) bool {
+	if p.policy.MaxLifetime > 0 && now.Sub(p.established[pooled.connection]) >= p.policy.MaxLifetime {
+		p.statistics.Expired++
+	} else if p.policy.IdleTimeout > 0 && now.Sub(pooled.since) >= p.policy.IdleTimeout {
+		p.statistics.IdleClosed++
+	} else {
+		return false
+	}
+
+	delete(p.established, pooled.connection)
+	return true
+}
+
+// Close all pooled connections exceeding the limits.
+func (p *connectionPool) reap() {
+	var expired []Connection
+	defer func() { closeAll(expired) }()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for address, connections := range p.available {
+		kept := connections[:0]
+		for _, pooled := range connections {
+			if p.evict(pooled, now) {
+				expired = append(expired, pooled.connection)
+				continue
+			}
+			kept = append(kept, pooled)
+		}
+
+		for i := len(kept); i < len(connections); i++ {
+			connections[i] = pooledConnection{}
+		}
+		if len(kept) == 0 {
+			delete(p.available, address)
+		} else {
+			p.available[address] = kept
+		}
+	}
+}
+
+// Snapshot of the current connections and counters.
+func (p *connectionPool) snapshot() PoolStatistics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	statistics := p.statistics
+	statistics.Open = len(p.established)
+	for _, connections := range p.available {
+		statistics.Idle += len(connections)
+	}
+	return statistics
+}
+
+// Close every open connection, no connection is accepted after.
+func (p *connectionPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+
+	// Errors are ignored, since connections can be already
+	// closed by a failure while still tracked.
+	for connection := range p.established {
+		connection.Close()
+		delete(p.established, connection)
+	}
+	for address := range p.available {
+		delete(p.available, address)
+	}
+}
+
+// Close the connections, ignoring errors.
+func closeAll(connections []Connection) {
+	for _, connection := range connections {
+		connection.Close()
+	}
+}
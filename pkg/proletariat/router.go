@@ -0,0 +1,170 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"runtime"
+	"sync"
+)
+
+// MessageTypeHeader is the header holding the type of the message,
+// used by the Router to select the handler. The name is reserved, so
+// messages with a "type" header of their own are not routed.
+const MessageTypeHeader = ":type"
+
+// Handler handles the messages of a type received by the Router.
+type Handler interface {
+	// Serve handles the datagram. When the datagram is a request, the
+	// returned data is the reply, or the error is replied instead.
+	Serve(Datagram) ([]byte, error)
+}
+
+// HandlerFunc is a function used as a Handler.
+type HandlerFunc func(Datagram) ([]byte, error)
+
+// Serve implements the Handler interface.
+func (h HandlerFunc) Serve(datagram Datagram) ([]byte, error) {
+	return h(datagram)
+}
+
+// RouterPolicy configures how the Router handles the messages.
+type RouterPolicy struct {
+	// Goroutines handling messages concurrently.
+	// Zero means a default of the number of CPUs.
+	Workers int
+
+	// Channel holding the messages waiting for a worker.
+	Receive ReceivePolicy
+
+	// Invoked with the errors that can not be replied to the sender,
+	// because the message is not a request or the reply failed.
+	Errors func(Datagram, error)
+}
+
+func (r RouterPolicy) workers() int {
+	if r.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return r.Workers
+}
+
+// Router dispatches the received messages to the handler registered
+// for the type in the MessageTypeHeader. Messages without a type are
+// not consumed by the Router and are available to Receive.
+//
+// Errors reach the sender only when the message is a request. The
+// request fails with a RemoteError matching ErrUnknownType when the
+// type has no handler, or holding the message of the error returned by
+// the handler. Other messages are not answered, so their errors are
+// only reported to the Errors of the policy.
+type Router struct {
+	// Synchronize the handlers.
+	mutex *sync.Mutex
+
+	// Communication receiving the messages and sending replies.
+	comm Communication
+
+	// How messages are handled.
+	policy RouterPolicy
+
+	// Handlers by message type.
+	handlers map[string]Handler
+
+	// Receives the messages with a type.
+	subscription *Subscription
+}
+
+// NewRouter creates a Router for the messages received by the
+// communication. Messages are only handled after the Router starts.
+func NewRouter(comm Communication, policy RouterPolicy) (*Router, error) {
+	typed := Filter{Headers: map[string][]byte{MessageTypeHeader: nil}}
+	subscription, err := comm.Subscribe(typed, policy.Receive)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		mutex:        &sync.Mutex{},
+		comm:         comm,
+		policy:       policy,
+		handlers:     make(map[string]Handler),
+		subscription: subscription,
+	}, nil
+}
+
+// Handle registers the handler for the message type.
+// Registering a type again replaces its handler.
+func (r *Router) Handle(messageType string, handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers[messageType] = handler
+}
+
+// HandleFunc registers the function for the message type.
+func (r *Router) HandleFunc(messageType string, handler func(Datagram) ([]byte, error)) {
+	r.Handle(messageType, HandlerFunc(handler))
+}
+
+// Start handles the messages using the workers.
+// This will block until the Router or the communication is closed.
+func (r *Router) Start() {
+	group := &sync.WaitGroup{}
+	for i := 0; i < r.policy.workers(); i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for datagram := range r.subscription.Receive() {
+				r.dispatch(datagram)
+			}
+		}()
+	}
+	group.Wait()
+}
+
+// Close stops receiving messages. Messages being handled finish.
+func (r *Router) Close() error {
+	return r.subscription.Close()
+}
+
+// Handle the datagram with the handler of its type, replying when the
+// datagram is a request.
+func (r *Router) dispatch(datagram Datagram) {
+	r.mutex.Lock()
+	handler, ok := r.handlers[string(datagram.Headers[MessageTypeHeader])]
+	r.mutex.Unlock()
+
+	var data []byte
+	err := ErrUnknownType
+	if ok {
+		data, err = handler.Serve(datagram)
+	}
+
+	if datagram.IsRequest() {
+		err = r.reply(datagram, data, err)
+	}
+
+	if err != nil && r.policy.Errors != nil {
+		r.policy.Errors(datagram, err)
+	}
+}
+
+// Reply the data or the error to the request, returning the error
+// if the reply fails.
+func (r *Router) reply(datagram Datagram, data []byte, err error) error {
+	if err != nil {
+		return r.comm.ReplyError(datagram, err)
+	}
+	return r.comm.Reply(datagram, data)
+}
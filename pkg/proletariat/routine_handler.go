@@ -59,6 +59,24 @@ func (h *GoRoutineHandler) Spawn(f func()) {
 	}()
 }
 
+// TrySpawn will spawn the new go routine if the handler is still working.
+// Returns `false` instead of panicking if the handler is already closed.
+func (h *GoRoutineHandler) TrySpawn(f func()) bool {
+	h.mutex.Lock()
+	if !h.working {
+		h.mutex.Unlock()
+		return false
+	}
+	h.group.Add(1)
+	h.mutex.Unlock()
+
+	go func() {
+		defer h.group.Done()
+		f()
+	}()
+	return true
+}
+
 // Close blocks while waiting for go routines to stop. This will set the
 // working mode to off, so after this is called any spawned go routine will panic.
 func (h *GoRoutineHandler) Close() {
@@ -17,38 +17,257 @@ package proletariat
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 )
 
+const defaultReceiveCapacity = 1024
+
+// OverflowPolicy defines what happens when publishing to a full channel.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock waits until the channel has space or the context
+	// is done. Messages not published before the timeout are dropped.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest drops the message being published.
+	OverflowDropNewest
+
+	// OverflowDropOldest removes the oldest message from the channel
+	// to publish the new one. Reliable messages removed are not sent
+	// again, since they were acknowledged when published.
+	OverflowDropOldest
+
+	// OverflowSpill holds the messages in an unbounded queue, moved to
+	// the channel as it is consumed. Nothing is dropped, but memory
+	// grows while the consumer falls behind.
+	OverflowSpill
+)
+
+// ReceivePolicy configures the channel holding the received messages
+// until consumed.
+type ReceivePolicy struct {
+	// Messages held by the channel.
+	// Zero means a default of 1024 messages.
+	Capacity int
+
+	// What happens when a message is received and the channel is full.
+	Overflow OverflowPolicy
+}
+
+func (r ReceivePolicy) capacity() int {
+	if r.Capacity <= 0 {
+		return defaultReceiveCapacity
+	}
+	return r.Capacity
+}
+
+// ReceiveStatistics counts what happened to the published messages.
+type ReceiveStatistics struct {
+	// Messages published to the channel, including the spilled ones.
+	Published uint64
+
+	// Messages not published because the channel was full, either
+	// dropped right away or after waiting until the timeout.
+	Dropped uint64
+
+	// Messages removed from the channel to publish newer ones.
+	Evicted uint64
+
+	// Messages held in the unbounded queue because the channel was full.
+	Spilled uint64
+}
+
+// Publisher receives the datagrams read by the connections.
+type Publisher interface {
+	// Publish the datagram, returns `true` if it was published.
+	Publish(context.Context, Datagram) bool
+}
+
 // SharedChannel is structure that holds a channel that can be
 // shared across multiple goroutines, without danger of publishing
 // to a closed channel nor data race while publishing and closing.
 type SharedChannel struct {
+	// Counters accessed atomically, kept first to be 64-bit aligned.
+	published uint64
+	dropped   uint64
+	evicted   uint64
+	spilled   uint64
+
 	mutex *sync.Mutex
 	flag  Flag
 	sc    chan Datagram
+
+	// What happens when the channel is full.
+	overflow OverflowPolicy
+
+	// Invoked for each message dropped or evicted, if present.
+	discard func(Datagram)
+
+	// Messages waiting for space in the channel, in order.
+	spill []Datagram
+
+	// Set while a goroutine moves the spilled messages.
+	pumping bool
+
+	// Stops moving the spilled messages and publishers waiting for
+	// space, and the group to wait for the spilled messages.
+	done  chan struct{}
+	pumps *sync.WaitGroup
 }
 
 func NewSharedChannel() *SharedChannel {
+	return NewSharedChannelWithPolicy(ReceivePolicy{})
+}
+
+// NewSharedChannelWithPolicy creates a SharedChannel with the capacity
+// and overflow of the policy.
+func NewSharedChannelWithPolicy(policy ReceivePolicy) *SharedChannel {
+	return newSharedChannel(policy, nil)
+}
+
+func newSharedChannel(policy ReceivePolicy, discard func(Datagram)) *SharedChannel {
 	return &SharedChannel{
-		mutex: &sync.Mutex{},
-		flag:  Flag{},
-		sc:    make(chan Datagram, 1024),
+		mutex:    &sync.Mutex{},
+		flag:     Flag{},
+		sc:       make(chan Datagram, policy.capacity()),
+		overflow: policy.Overflow,
+		discard:  discard,
+		done:     make(chan struct{}),
+		pumps:    &sync.WaitGroup{},
 	}
 }
 
 // Publish will try to publish the message, if successful will return `true`,
-// if the channel is closed or the context is done, returns `false`.
+// if the channel is closed, the context is done or the message is dropped
+// because the channel is full, returns `false`.
 func (s *SharedChannel) Publish(ctx context.Context, datagram Datagram) bool {
 	if s.flag.IsActive() {
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
+		if s.flag.IsInactive() {
+			return false
+		}
+
+		switch s.overflow {
+		case OverflowDropNewest:
+			select {
+			case s.sc <- datagram:
+			default:
+				s.drop(datagram)
+				return false
+			}
+		case OverflowDropOldest:
+			s.replaceOldest(datagram)
+		case OverflowSpill:
+			s.publishOrSpill(datagram)
+		default:
+			// Closing stops the wait, since it needs the mutex held here.
+			select {
+			case <-ctx.Done():
+				// A cancelled context is not a drop, the publisher is closing.
+				if ctx.Err() == context.DeadlineExceeded {
+					s.drop(datagram)
+				}
+				return false
+			case <-s.done:
+				return false
+			case s.sc <- datagram:
+			}
+		}
+		atomic.AddUint64(&s.published, 1)
+		return true
+	}
+	return false
+}
+
+// Count the message dropped.
+// Must be called while holding the mutex.
+func (s *SharedChannel) drop(datagram Datagram) {
+	atomic.AddUint64(&s.dropped, 1)
+	if s.discard != nil {
+		s.discard(datagram)
+	}
+}
+
+// Publish the message, removing the oldest ones until there is space.
+// Must be called while holding the mutex.
+func (s *SharedChannel) replaceOldest(datagram Datagram) {
+	for {
 		select {
-		case <-ctx.Done():
 		case s.sc <- datagram:
-			return true
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-s.sc:
+			atomic.AddUint64(&s.evicted, 1)
+			if s.discard != nil {
+				s.discard(oldest)
+			}
+			oldest.Release()
+		default:
 		}
 	}
-	return false
+}
+
+// Publish the message, or hold it if the channel is full or there are
+// already messages held, so the order is kept.
+// Must be called while holding the mutex.
+func (s *SharedChannel) publishOrSpill(datagram Datagram) {
+	if len(s.spill) == 0 {
+		select {
+		case s.sc <- datagram:
+			return
+		default:
+		}
+	}
+
+	s.spill = append(s.spill, datagram)
+	atomic.AddUint64(&s.spilled, 1)
+	if !s.pumping {
+		s.pumping = true
+		s.pumps.Add(1)
+		go s.pump()
+	}
+}
+
+// Move the spilled messages to the channel, until none is left or
+// the channel is closed.
+func (s *SharedChannel) pump() {
+	defer s.pumps.Done()
+	for {
+		s.mutex.Lock()
+		if len(s.spill) == 0 {
+			s.pumping = false
+			s.mutex.Unlock()
+			return
+		}
+		datagram := s.spill[0]
+		s.mutex.Unlock()
+
+		select {
+		case <-s.done:
+			return
+		case s.sc <- datagram:
+		}
+
+		s.mutex.Lock()
+		s.spill[0] = Datagram{}
+		s.spill = s.spill[1:]
+		s.mutex.Unlock()
+	}
+}
+
+// Statistics returns a snapshot of the counters.
+func (s *SharedChannel) Statistics() ReceiveStatistics {
+	return ReceiveStatistics{
+		Published: atomic.LoadUint64(&s.published),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		Evicted:   atomic.LoadUint64(&s.evicted),
+		Spilled:   atomic.LoadUint64(&s.spilled),
+	}
 }
 
 // Consume will return the channel to listen to messages.
@@ -57,10 +276,15 @@ func (s *SharedChannel) Consume() <-chan Datagram {
 }
 
 // Close will close the channel.
+// Messages still spilled or waiting for space are discarded.
 func (s *SharedChannel) Close() error {
 	if s.flag.Inactivate() {
+		close(s.done)
+		s.pumps.Wait()
+
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
+		s.spill = nil
 		close(s.sc)
 	}
 	return nil
@@ -0,0 +1,633 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Time to wait for a dialing peer to identify itself.
+	preambleTimeout = time.Second
+)
+
+var (
+	ErrPartitioned = errors.New("network is partitioned")
+)
+
+// LatencyDistribution returns the latency applied to a single message.
+// The random source is the seeded source of the link direction.
+type LatencyDistribution func(random *rand.Rand) time.Duration
+
+// FixedLatency delays every message by the same duration.
+func FixedLatency(latency time.Duration) LatencyDistribution {
+	return func(*rand.Rand) time.Duration {
+		return latency
+	}
+}
+
+// UniformLatency delays messages uniformly between min and max.
+func UniformLatency(min, max time.Duration) LatencyDistribution {
+	return func(random *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(random.Int63n(int64(max-min)))
+	}
+}
+
+// NormalLatency delays messages following a normal distribution,
+// values below zero are truncated.
+func NormalLatency(mean, deviation time.Duration) LatencyDistribution {
+	return func(random *rand.Rand) time.Duration {
+		latency := time.Duration(random.NormFloat64()*float64(deviation)) + mean
+		if latency < 0 {
+			return 0
+		}
+		return latency
+	}
+}
+
+// Link holds the conditions applied to messages sent from one
+// address to another. The zero value is a perfect link.
+type Link struct {
+	// Distribution of the latency for each message.
+	// Varying latency will reorder messages.
+	Latency LatencyDistribution
+
+	// Probability between 0 and 1 of a message being dropped.
+	Drop float64
+
+	// Probability between 0 and 1 of a message being delivered twice.
+	Duplicate float64
+
+	// Maximum amount of bytes per second, zero means unlimited.
+	Bandwidth int
+}
+
+// Identifies the direction of a link.
+type direction struct {
+	from Address
+	to   Address
+}
+
+// SimulatedNetwork wraps transports created by another factory to
+// simulate an unreliable network. Links between addresses can be
+// configured with latency, loss, duplication and bandwidth, and
+// sets of addresses can be partitioned from each other.
+//
+// Random decisions are taken from a source for each direction, seeded
+// with the seed and the addresses, so the same sequence of messages
+// over a direction produces the same failures.
+// The data written to a connection is split into frames using the
+// codec of the network, and each frame is handled as a single message.
+type SimulatedNetwork struct {
+	mutex *sync.Mutex
+
+	// Seed of the random sources.
+	seed int64
+
+	// Source for the random decisions, by direction.
+	sources map[direction]*rand.Rand
+
+	// Factory to create the underlying transports.
+	factory TransportFactory
+
+	// Codec splitting the written data into frames.
+	codec Codec
+
+	// Link used when no specific link is configured.
+	defaults Link
+
+	// Configured links for each direction.
+	links map[direction]Link
+
+	// Directions that are currently partitioned.
+	partitions map[direction]bool
+}
+
+// NewSimulatedNetwork creates a new network on top of transports created
+// by the given factory, using the seed for every random decision.
+func NewSimulatedNetwork(factory TransportFactory, seed int64) *SimulatedNetwork {
+	return &SimulatedNetwork{
+		mutex:      &sync.Mutex{},
+		seed:       seed,
+		sources:    make(map[direction]*rand.Rand),
+		factory:    factory,
+		links:      make(map[direction]Link),
+		partitions: make(map[direction]bool),
+	}
+}
+
+// SetDefaultLink configures the link used between addresses
+// without a specific configuration.
+func (s *SimulatedNetwork) SetDefaultLink(link Link) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaults = link
+}
+
+// SetCodec configures the codec used by the communications on the
+// network, so the written data is split into frames. Connections created
+// after the change use the new codec. Defaults to the MsgpackCodec.
+func (s *SimulatedNetwork) SetCodec(codec Codec) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.codec = codec
+}
+
+// SetLink configures the link for messages sent from one address to another.
+func (s *SimulatedNetwork) SetLink(from, to Address, link Link) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.links[direction{from: from, to: to}] = link
+}
+
+// Partition isolates every address in one set from every address in the
+// other, in both directions. Messages in flight are dropped, writes and
+// dials fail with ErrPartitioned until the partition is healed.
+func (s *SimulatedNetwork) Partition(one, other []Address) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, a := range one {
+		for _, b := range other {
+			s.partitions[direction{from: a, to: b}] = true
+			s.partitions[direction{from: b, to: a}] = true
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (s *SimulatedNetwork) Heal() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partitions = make(map[direction]bool)
+}
+
+// NewTransport creates a new simulated transport bound to the given address.
+// This method can be used as a TransportFactory.
+func (s *SimulatedNetwork) NewTransport(ctx context.Context, address Address) (Transport, error) {
+	transport, err := s.factory(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	simulated := &simulatedTransport{
+		Transport: transport,
+		network:   s,
+		addr:      Address(transport.Addr().String()),
+		mutex:     &sync.Mutex{},
+		greeting:  make(map[net.Conn]bool),
+		accepted:  make(chan acceptedConn),
+		stopped:   make(chan struct{}),
+	}
+	go simulated.accept()
+	return simulated, nil
+}
+
+// The codec splitting the written data into frames.
+func (s *SimulatedNetwork) framing() Codec {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.codec == nil {
+		return MsgpackCodec{}
+	}
+	return s.codec
+}
+
+// Verify if the direction is partitioned.
+func (s *SimulatedNetwork) isPartitioned(from, to Address) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.partitions[direction{from: from, to: to}]
+}
+
+// Decide the fate of a message, returning the latency of each copy
+// that will be delivered. No copies means the message was dropped.
+func (s *SimulatedNetwork) plan(from, to Address) ([]time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d := direction{from: from, to: to}
+	if s.partitions[d] {
+		return nil, ErrPartitioned
+	}
+
+	link, ok := s.links[d]
+	if !ok {
+		link = s.defaults
+	}
+
+	random := s.source(d)
+	if link.Drop > 0 && random.Float64() < link.Drop {
+		return nil, nil
+	}
+
+	copies := 1
+	if link.Duplicate > 0 && random.Float64() < link.Duplicate {
+		copies++
+	}
+
+	latencies := make([]time.Duration, copies)
+	for i := range latencies {
+		if link.Latency != nil {
+			latencies[i] = link.Latency(random)
+		}
+	}
+	return latencies, nil
+}
+
+// The random source of the direction, must be called while holding the lock.
+func (s *SimulatedNetwork) source(d direction) *rand.Rand {
+	random, ok := s.sources[d]
+	if !ok {
+		hash := fnv.New64a()
+		hash.Write([]byte(d.from))
+		hash.Write([]byte{0})
+		hash.Write([]byte(d.to))
+		random = rand.New(rand.NewSource(s.seed ^ int64(hash.Sum64())))
+		s.sources[d] = random
+	}
+	return random
+}
+
+// Time to transmit the given amount of bytes over the link.
+func (s *SimulatedNetwork) transmission(from, to Address, size int) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	link, ok := s.links[direction{from: from, to: to}]
+	if !ok {
+		link = s.defaults
+	}
+
+	if link.Bandwidth <= 0 {
+		return 0
+	}
+	return time.Duration(int64(size) * int64(time.Second) / int64(link.Bandwidth))
+}
+
+// A connection accepted after the dialing peer identified itself.
+type acceptedConn struct {
+	conn net.Conn
+	peer Address
+}
+
+// A transport that wraps the connections to apply the network conditions.
+// The dialing side writes its address before any data, so the accepting
+// side knows the link for the messages it writes back. The address is
+// read apart from accepting, so a slow peer does not delay the others.
+type simulatedTransport struct {
+	Transport
+
+	// Network with the link conditions.
+	network *SimulatedNetwork
+
+	// Address of the underlying transport.
+	addr Address
+
+	// Synchronize the connections being greeted.
+	mutex *sync.Mutex
+
+	// Connections waiting for the address of the dialing peer.
+	greeting map[net.Conn]bool
+
+	// Connections ready to be accepted.
+	accepted chan acceptedConn
+
+	// Closed when the underlying transport stops accepting, after
+	// the failure is set.
+	stopped chan struct{}
+	failure error
+}
+
+// Accept connections from the underlying transport until it fails,
+// reading the address of each dialing peer apart. Connections still
+// being greeted are closed when it stops.
+func (t *simulatedTransport) accept() {
+	defer func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		for conn := range t.greeting {
+			conn.Close()
+		}
+	}()
+	defer close(t.stopped)
+
+	for {
+		conn, err := t.Transport.Accept()
+		if err != nil {
+			t.failure = err
+			return
+		}
+
+		t.mutex.Lock()
+		t.greeting[conn] = true
+		t.mutex.Unlock()
+		go t.greet(conn)
+	}
+}
+
+// Read the address of the dialing peer, handing the connection to Accept.
+func (t *simulatedTransport) greet(conn net.Conn) {
+	peer, err := readPreamble(conn)
+	t.mutex.Lock()
+	delete(t.greeting, conn)
+	t.mutex.Unlock()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case t.accepted <- acceptedConn{conn: conn, peer: peer}:
+	case <-t.stopped:
+		conn.Close()
+	}
+}
+
+// Accept implement Transport interface.
+func (t *simulatedTransport) Accept() (net.Conn, error) {
+	select {
+	case accepted := <-t.accepted:
+		return newSimulatedConn(accepted.conn, t.network, t.addr, accepted.peer), nil
+	case <-t.stopped:
+		return nil, t.failure
+	}
+}
+
+// Dial implement Transport interface.
+func (t *simulatedTransport) Dial(address Address, timeout time.Duration) (net.Conn, error) {
+	if t.network.isPartitioned(t.addr, address) {
+		return nil, ErrPartitioned
+	}
+
+	conn, err := t.Transport.Dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writePreamble(conn, t.addr, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newSimulatedConn(conn, t.network, t.addr, address), nil
+}
+
+// Write the local address to the connection.
+func writePreamble(conn net.Conn, address Address, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	preamble := make([]byte, 2+len(address))
+	binary.BigEndian.PutUint16(preamble, uint16(len(address)))
+	copy(preamble[2:], address)
+	_, err := conn.Write(preamble)
+	return err
+}
+
+// Read the address of the dialing peer.
+func readPreamble(conn net.Conn) (Address, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(preambleTimeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+
+	address := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(conn, address); err != nil {
+		return "", err
+	}
+	return Address(address), nil
+}
+
+// A frame waiting to be written to the underlying connection.
+type delayedWrite struct {
+	due   time.Time
+	order uint64
+	data  []byte
+}
+
+// A connection applying the link conditions to every frame written.
+// Frames are delivered to the underlying connection by a goroutine,
+// ordered by the time they are due.
+type simulatedConn struct {
+	net.Conn
+
+	// Network with the link conditions.
+	network *SimulatedNetwork
+
+	// Direction of the writes.
+	from Address
+	to   Address
+
+	// Receives the written data to split into frames.
+	written *io.PipeWriter
+
+	// Synchronize the pending writes.
+	mutex *sync.Mutex
+
+	// Writes sorted by due time.
+	pending []delayedWrite
+
+	// Order of the writes, to break ties.
+	order uint64
+
+	// When the link will finish transmitting the previous writes.
+	busy time.Time
+
+	// Flag to transition to closed only once.
+	flag Flag
+
+	// Notify the delivery goroutine about a new write.
+	wake chan bool
+
+	// Closed when the connection is closed.
+	closed chan bool
+}
+
+func newSimulatedConn(conn net.Conn, network *SimulatedNetwork, from, to Address) net.Conn {
+	reader, writer := io.Pipe()
+	c := &simulatedConn{
+		Conn:    conn,
+		network: network,
+		from:    from,
+		to:      to,
+		written: writer,
+		mutex:   &sync.Mutex{},
+		wake:    make(chan bool, 1),
+		closed:  make(chan bool),
+	}
+	go c.split(reader, network.framing())
+	go c.deliver()
+	return c
+}
+
+// Write implements the net.Conn interface.
+// The link conditions are applied to each frame once it is completely
+// written. A dropped frame is reported as written, as would happen on
+// a real network.
+func (c *simulatedConn) Write(b []byte) (int, error) {
+	if c.flag.IsInactive() {
+		return 0, c.closedError()
+	}
+
+	if c.network.isPartitioned(c.from, c.to) {
+		return 0, ErrPartitioned
+	}
+
+	if _, err := c.written.Write(b); err != nil {
+		return 0, c.closedError()
+	}
+	return len(b), nil
+}
+
+// The error of writing to the closed connection.
+func (c *simulatedConn) closedError() error {
+	return &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: errMemoryClosed}
+}
+
+// Split the written data into frames, sending each one over the link.
+// Stops when the connection is closed or the data is not a frame.
+func (c *simulatedConn) split(written *io.PipeReader, framing Codec) {
+	defer written.Close()
+	decoder := framing.NewDecoder(written)
+	encoded := &bytes.Buffer{}
+	encoder := framing.NewEncoder(encoded)
+	for {
+		frame, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+
+		err = encoder.Encode(frame)
+		if frame.buffer != nil {
+			releaseBuffer(frame.buffer)
+		}
+		if err != nil {
+			return
+		}
+
+		c.send(encoded.Bytes())
+		encoded.Reset()
+	}
+}
+
+// Send the frame over the link, holding each copy until it is due.
+// A frame sent while the link is partitioned is dropped.
+func (c *simulatedConn) send(frame []byte) {
+	latencies, err := c.network.plan(c.from, c.to)
+	if err != nil {
+		return
+	}
+
+	transmission := c.network.transmission(c.from, c.to, len(frame))
+	c.mutex.Lock()
+	now := time.Now()
+	if c.busy.Before(now) {
+		c.busy = now
+	}
+	c.busy = c.busy.Add(transmission)
+	for _, latency := range latencies {
+		data := make([]byte, len(frame))
+		copy(data, frame)
+		c.order++
+		c.pending = append(c.pending, delayedWrite{due: c.busy.Add(latency), order: c.order, data: data})
+	}
+	sort.Slice(c.pending, func(i, j int) bool {
+		if c.pending[i].due.Equal(c.pending[j].due) {
+			return c.pending[i].order < c.pending[j].order
+		}
+		return c.pending[i].due.Before(c.pending[j].due)
+	})
+	c.mutex.Unlock()
+
+	select {
+	case c.wake <- true:
+	default:
+	}
+}
+
+// Retrieve the next write that is due, or how long to wait for it.
+func (c *simulatedConn) next() (*delayedWrite, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pending) == 0 {
+		return nil, -1
+	}
+
+	if wait := time.Until(c.pending[0].due); wait > 0 {
+		return nil, wait
+	}
+
+	write := c.pending[0]
+	c.pending = c.pending[1:]
+	return &write, 0
+}
+
+// Deliver the pending writes when they are due, writes that are due while
+// the link is partitioned are dropped.
+func (c *simulatedConn) deliver() {
+	for {
+		write, wait := c.next()
+		if write != nil {
+			if c.network.isPartitioned(c.from, c.to) {
+				continue
+			}
+
+			if _, err := c.Conn.Write(write.data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var expired <-chan time.Time
+		if wait > 0 {
+			expired = time.After(wait)
+		}
+
+		select {
+		case <-c.closed:
+			return
+		case <-c.wake:
+		case <-expired:
+		}
+	}
+}
+
+// Close implements the net.Conn interface.
+// Pending writes are discarded.
+func (c *simulatedConn) Close() error {
+	if c.flag.Inactivate() {
+		close(c.closed)
+		c.written.Close()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// Filter selects the messages delivered to a subscription.
+// The zero Filter matches every message.
+type Filter struct {
+	// Only messages sent by the address, when present.
+	From Address
+
+	// Only messages carrying all the headers. A header with a nil
+	// value matches any value, otherwise the values must be equal.
+	Headers map[string][]byte
+
+	// Only messages with a payload starting with the prefix, when present.
+	Prefix []byte
+}
+
+// Verify if the datagram matches every criteria of the filter.
+func (f Filter) matches(datagram Datagram) bool {
+	if len(f.From) > 0 && datagram.From != f.From {
+		return false
+	}
+
+	for key, expected := range f.Headers {
+		value, ok := datagram.Headers[key]
+		if !ok || (expected != nil && !bytes.Equal(expected, value)) {
+			return false
+		}
+	}
+
+	if len(f.Prefix) > 0 {
+		return datagram.Data != nil && bytes.HasPrefix(datagram.Data.Bytes(), f.Prefix)
+	}
+	return true
+}
+
+// Subscription receives the messages matching its filter, in its own
+// channel. A message matching many subscriptions is delivered to all
+// of them, each one holding its own copy of the payload. The headers
+// are shared between the copies and must not be modified.
+type Subscription struct {
+	// Messages delivered to the subscription.
+	filter Filter
+
+	// Holds the messages until consumed.
+	channel *SharedChannel
+
+	// Subscriptions of the primitive.
+	owner *subscribers
+}
+
+// Receive returns the channel to listen to the messages.
+// The channel is closed after the subscription closes.
+func (s *Subscription) Receive() <-chan Datagram {
+	return s.channel.Consume()
+}
+
+// Statistics returns a snapshot of the messages published to the
+// subscription and the ones dropped.
+func (s *Subscription) Statistics() ReceiveStatistics {
+	return s.channel.Statistics()
+}
+
+// Close stops delivering messages to the subscription.
+func (s *Subscription) Close() error {
+	s.owner.remove(s)
+	return s.channel.Close()
+}
+
+// Delivers the received messages to the subscriptions, and the ones
+// not matched by any subscription to the fallback channel.
+type subscribers struct {
+	// Synchronize the subscriptions.
+	mutex *sync.Mutex
+
+	// Set after closing, no subscription is accepted after.
+	closed bool
+
+	// Current subscriptions, in the order created.
+	subscriptions []*Subscription
+
+	// Receives the messages not matched by any subscription.
+	fallback *SharedChannel
+
+	// Invoked for each message dropped by a subscription.
+	discard func(Datagram)
+}
+
+func newSubscribers(fallback *SharedChannel, discard func(Datagram)) *subscribers {
+	return &subscribers{
+		mutex:    &sync.Mutex{},
+		fallback: fallback,
+		discard:  discard,
+	}
+}
+
+// Create a subscription delivering the messages matching the filter,
+// held by a channel created with the policy.
+func (s *subscribers) subscribe(filter Filter, policy ReceivePolicy) (*Subscription, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrAlreadyClosed
+	}
+
+	subscription := &Subscription{
+		filter:  filter,
+		channel: newSharedChannel(policy, s.discard),
+		owner:   s,
+	}
+	s.subscriptions = append(s.subscriptions, subscription)
+	return subscription, nil
+}
+
+// Stop delivering messages to the subscription.
+func (s *subscribers) remove(subscription *Subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, current := range s.subscriptions {
+		if current == subscription {
+			s.subscriptions = append(s.subscriptions[:i:i], s.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Publish implements the Publisher interface.
+// The datagram is published to every matching subscription, or to the
+// fallback channel when none matches. Returns `true` if published to
+// at least one channel.
+func (s *subscribers) Publish(ctx context.Context, datagram Datagram) bool {
+	s.mutex.Lock()
+	var matched []*Subscription
+	for _, subscription := range s.subscriptions {
+		if subscription.filter.matches(datagram) {
+			matched = append(matched, subscription)
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(matched) == 0 {
+		return s.fallback.Publish(ctx, datagram)
+	}
+
+	// Copies are created before publishing, since the original can be
+	// consumed and released right after published.
+	datagrams := make([]Datagram, len(matched))
+	datagrams[0] = datagram
+	for i := 1; i < len(matched); i++ {
+		datagrams[i] = datagram.clone()
+	}
+
+	published := false
+	for i, subscription := range matched {
+		if subscription.channel.Publish(ctx, datagrams[i]) {
+			published = true
+		}
+	}
+	return published
+}
+
+// Close every subscription and the fallback channel.
+func (s *subscribers) close() error {
+	s.mutex.Lock()
+	s.closed = true
+	subscriptions := s.subscriptions
+	s.subscriptions = nil
+	s.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.channel.Close()
+	}
+	return s.fallback.Close()
+}
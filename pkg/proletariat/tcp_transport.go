@@ -29,6 +29,12 @@ type TCP struct {
 
 // NewTCPTransport create a new TCP stream with the given address to bind.
 func NewTCPTransport(parent context.Context, address Address) (Transport, error) {
+	return listenTCP(parent, address)
+}
+
+// Bind the TCP listener to the given address, verifying that the
+// resolved address can be used by other peers to reach this one.
+func listenTCP(parent context.Context, address Address) (*TCP, error) {
 	var lc net.ListenConfig
 	listening, err := lc.Listen(parent, "tcp", string(address))
 	if err != nil {
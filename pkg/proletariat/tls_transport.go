@@ -0,0 +1,84 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// A TLS transport that implements the Transport interface.
+// Connections are accepted and dialed over TCP and secured using the
+// same tls.Config for both sides. The configuration must contain the
+// certificate presented by this peer and the pool used to verify the
+// other peers. For mutual TLS, set `ClientAuth` to
+// `tls.RequireAndVerifyClientCert` and provide the `ClientCAs` pool.
+type TLS struct {
+	addr     net.Addr
+	listener net.Listener
+	config   *tls.Config
+}
+
+// NewTLSTransport create a new TLS stream with the given address to bind.
+func NewTLSTransport(parent context.Context, address Address, config *tls.Config) (Transport, error) {
+	if config == nil {
+		return nil, ErrMissingTLS
+	}
+
+	tcp, err := listenTCP(parent, address)
+	if err != nil {
+		return nil, err
+	}
+	t := &TLS{
+		addr:     tcp.addr,
+		listener: tls.NewListener(tcp.listener, config),
+		config:   config,
+	}
+	return t, nil
+}
+
+// NewTLSTransportFactory creates a TransportFactory that binds TLS
+// transports using the given configuration.
+func NewTLSTransportFactory(config *tls.Config) TransportFactory {
+	return func(ctx context.Context, address Address) (Transport, error) {
+		return NewTLSTransport(ctx, address, config)
+	}
+}
+
+// Accept implement Transport interface.
+// The handshake is executed lazily, on the first read or write.
+func (t *TLS) Accept() (net.Conn, error) {
+	return t.listener.Accept()
+}
+
+// Close implement Transport interface.
+func (t *TLS) Close() error {
+	return t.listener.Close()
+}
+
+// Addr implement Transport interface.
+func (t *TLS) Addr() net.Addr {
+	return t.addr
+}
+
+// Dial implement Transport interface.
+// The handshake is executed before returning the connection, so
+// a peer that can not be verified will fail here.
+func (t *TLS) Dial(address Address, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), t.config)
+}
@@ -15,6 +15,7 @@
 package proletariat
 
 import (
+	"context"
 	"net"
 	"time"
 )
@@ -26,3 +27,7 @@ type Transport interface {
 	// Dial to the given address to send requests.
 	Dial(address Address, timeout time.Duration) (net.Conn, error)
 }
+
+// TransportFactory creates a Transport bound to the given address.
+// The context bounds the life-cycle of the created Transport.
+type TransportFactory func(ctx context.Context, address Address) (Transport, error)
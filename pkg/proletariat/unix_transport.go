@@ -0,0 +1,145 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proletariat
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// UnixScheme is the prefix for addresses using unix domain sockets,
+	// e.g. `unix:///run/app.sock`.
+	UnixScheme = "unix://"
+
+	// Timeout used to verify if an existing socket file is still in use.
+	staleSocketTimeout = 100 * time.Millisecond
+)
+
+// A unix domain socket address. The string representation
+// contains the scheme, so it can be used as an Address.
+type unixAddr struct {
+	path string
+}
+
+// Network implements the net.Addr interface.
+func (u unixAddr) Network() string {
+	return "unix"
+}
+
+// String implements the net.Addr interface.
+func (u unixAddr) String() string {
+	return UnixScheme + u.path
+}
+
+// A Unix transport that implements the Transport interface.
+// Connections are stream sockets bound to a file on the local
+// file system, so only peers on the same host can be reached.
+type Unix struct {
+	addr     unixAddr
+	listener net.Listener
+}
+
+// NewUnixTransport create a new unix stream with the given address to bind.
+// If the socket file already exists and no other process is listening on it,
+// the stale file is removed before binding.
+func NewUnixTransport(parent context.Context, address Address) (Transport, error) {
+	path, err := unixPath(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	listening, err := lc.Listen(parent, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Unix{addr: unixAddr{path: path}, listener: listening}, nil
+}
+
+// Extract the socket path from the address, the path must be absolute.
+func unixPath(address Address) (string, error) {
+	value := string(address)
+	if !strings.HasPrefix(value, UnixScheme) {
+		return "", ErrInvalidAddr
+	}
+
+	path := strings.TrimPrefix(value, UnixScheme)
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return "", ErrInvalidAddr
+	}
+	return path, nil
+}
+
+// Remove the socket file left behind by a process that did not close
+// the listener. A file that is not a socket or that still accepts
+// connections will not be removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return ErrInvalidAddr
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleSocketTimeout)
+	if err == nil {
+		conn.Close()
+		return ErrAddrInUse
+	}
+	return os.Remove(path)
+}
+
+// Accept implement Transport interface.
+func (u *Unix) Accept() (net.Conn, error) {
+	return u.listener.Accept()
+}
+
+// Close implement Transport interface.
+// The socket file is removed after the listener is closed.
+func (u *Unix) Close() error {
+	err := u.listener.Close()
+	if rmErr := os.Remove(u.addr.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// Addr implement Transport interface.
+func (u *Unix) Addr() net.Addr {
+	return u.addr
+}
+
+// Dial implement Transport interface.
+func (u *Unix) Dial(address Address, timeout time.Duration) (net.Conn, error) {
+	path, err := unixPath(address)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("unix", path, timeout)
+}
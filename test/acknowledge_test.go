@@ -0,0 +1,152 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcknowledge_DeliveredWhenSent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Acknowledge = true
+	})
+	defer closePair(t, cancel, first, second)
+
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+
+		// The message is available as soon as the send returns.
+		select {
+		case d := <-first.Receive():
+			if d.Data.String() != "hello" {
+				t.Errorf("expected hello. found %s", d.Data.String())
+			}
+		default:
+			t.Fatalf("message should be published before the acknowledgement")
+		}
+	}
+}
+
+func TestAcknowledge_RetryAfterLoss(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	retry := proletariat.RetryPolicy{Attempts: 5, Timeout: 100 * time.Millisecond, Backoff: 10 * time.Millisecond}
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Acknowledge = true
+		configuration.Retry = retry
+	})
+	defer closePair(t, cancel, first, second)
+
+	network.SetLink("second", "first", proletariat.Link{Drop: 1})
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		network.SetLink("second", "first", proletariat.Link{})
+	}()
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("should succeed after retrying. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 1 {
+		t.Errorf("expected 1. found %d", received)
+	}
+}
+
+func TestAcknowledge_NotAcknowledged(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	retry := proletariat.RetryPolicy{Attempts: 2, Timeout: 50 * time.Millisecond}
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Acknowledge = true
+		configuration.Retry = retry
+	})
+	defer closePair(t, cancel, first, second)
+
+	// Acknowledgements are lost, so the message is delivered on every attempt.
+	network.SetLink("first", "second", proletariat.Link{Drop: 1})
+	if err := second.Send("first", []byte("hello")); err != proletariat.ErrNotAcknowledged {
+		t.Fatalf("should not be acknowledged. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 2 {
+		t.Errorf("expected 2. found %d", received)
+	}
+}
+
+func TestAcknowledge_BothDirections(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Acknowledge = true
+		configuration.Retry = proletariat.RetryPolicy{Attempts: 1, Timeout: time.Second}
+	})
+
+	// Both peers send over the shared connections while acknowledging
+	// the messages received, so both are answering at the same time.
+	senders, messages := 4, 200
+	errs := make(chan error, 2*senders*messages)
+	wg := &sync.WaitGroup{}
+	for _, pair := range [][]proletariat.Communication{{first, second}, {second, first}} {
+		from, to := pair[0], proletariat.Address(pair[1].Addr().String())
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < messages; j++ {
+					if err := from.Send(to, []byte("hello")); err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+	}
+
+	consumed := make(chan struct{})
+	for _, comm := range []proletariat.Communication{first, second} {
+		go func(comm proletariat.Communication) {
+			for range comm.Receive() {
+			}
+			consumed <- struct{}{}
+		}(comm)
+	}
+
+	started := time.Now()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("failed sending. %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("sending took too long. %v", elapsed)
+	}
+
+	closePair(t, cancel, first, second)
+	<-consumed
+	<-consumed
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestBatch_DeliversAllMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		if configuration.Address == "second" {
+			configuration.Batch = proletariat.BatchPolicy{MaxSize: 4096}
+		}
+	})
+
+	sendMultipleMessages(first, second, 1024, t)
+	closePair(t, cancel, first, second)
+}
+
+func TestBatch_FlushedAfterLinger(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		if configuration.Address == "second" {
+			configuration.Batch = proletariat.BatchPolicy{MaxSize: 4096, Linger: 200 * time.Millisecond}
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// The message waits in the batch until the linger expires.
+	select {
+	case <-first.Receive():
+		t.Fatalf("message should wait for the linger")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	select {
+	case d := <-first.Receive():
+		if d.Data.String() != "hello" {
+			t.Errorf("expected hello. found %s", d.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestBatch_FlushedWhenClosing(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		if configuration.Address == "second" {
+			configuration.Batch = proletariat.BatchPolicy{MaxSize: 4096, Linger: time.Minute}
+		}
+	})
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 10 {
+		t.Errorf("expected 10. found %d", received)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func createBreakerCommunication(t *testing.T, ctx context.Context, network *proletariat.MemoryNetwork, clock proletariat.Clock) (proletariat.Communication, *countingTransport) {
+	counting := &countingTransport{}
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "second",
+		Ctx:     ctx,
+		Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			transport, err := network.NewTransport(ctx, address)
+			counting.Transport = transport
+			return counting, err
+		},
+		CircuitBreaker: proletariat.CircuitBreakerPolicy{FailureThreshold: 3, ProbeInterval: time.Second},
+		Clock:          clock,
+	})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go comm.Start()
+	return comm, counting
+}
+
+// Sends until the circuit opens, verifying the peer was dialed on every failure.
+func openCircuit(t *testing.T, comm proletariat.Communication, counting *countingTransport) {
+	for i := 0; i < 3; i++ {
+		err := comm.Send("first", []byte("hello"))
+		var open *proletariat.CircuitOpenError
+		if err == nil || errors.As(err, &open) {
+			t.Fatalf("should fail dialing. %v", err)
+		}
+	}
+
+	dials := atomic.LoadInt64(&counting.dials)
+	err := comm.Send("first", []byte("hello"))
+	var open *proletariat.CircuitOpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("circuit should be open. %v", err)
+	}
+
+	if open.Address != "first" || open.State != proletariat.CircuitOpen {
+		t.Errorf("unexpected error %+v", open)
+	}
+
+	if atomic.LoadInt64(&counting.dials) != dials {
+		t.Errorf("should not dial while open")
+	}
+}
+
+func TestCircuitBreaker_OpenAfterFailures(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	comm, counting := createBreakerCommunication(t, ctx, network, clock)
+	openCircuit(t, comm, counting)
+
+	// The probe fails, so the circuit opens again.
+	clock.Advance(time.Second)
+	err := comm.Send("first", []byte("hello"))
+	var open *proletariat.CircuitOpenError
+	if err == nil || errors.As(err, &open) {
+		t.Fatalf("probe should fail dialing. %v", err)
+	}
+
+	if err = comm.Send("first", []byte("hello")); !errors.As(err, &open) {
+		t.Fatalf("circuit should be open again. %v", err)
+	}
+
+	// Other peers are not affected.
+	if err = comm.Send("third", []byte("hello")); errors.As(err, &open) {
+		t.Errorf("circuit to other peer should be closed. %v", err)
+	}
+
+	cancel()
+	if err = comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestCircuitBreaker_CloseAfterProbe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	comm, counting := createBreakerCommunication(t, ctx, network, clock)
+	openCircuit(t, comm, counting)
+
+	first, err := proletariat.NewCommunication(proletariat.Configuration{Address: "first", Ctx: ctx, Transport: network.NewTransport})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go first.Start()
+	defer closePair(t, cancel, first, comm)
+
+	clock.Advance(time.Second)
+	for i := 0; i < 5; i++ {
+		if err = comm.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	if received := countReceived(first, 50*time.Millisecond); received != 5 {
+		t.Errorf("expected 5. found %d", received)
+	}
+}
+
+func TestCircuitBreaker_IgnoreRefusedFrames(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Codec = proletariat.LengthPrefixedCodec{MaxFrameSize: 64}
+		configuration.CircuitBreaker = proletariat.CircuitBreakerPolicy{FailureThreshold: 2}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := second.Send("first", make([]byte, 128)); err != proletariat.ErrFrameTooLarge {
+			t.Fatalf("should refuse the frame. %v", err)
+		}
+	}
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending after refused frames. %v", err)
+	}
+
+	// The healthy connection is kept.
+	if statistics := second.Statistics(); statistics.Dialed != 1 {
+		t.Errorf("expected 1 dialed. found %+v", statistics)
+	}
+
+	if received := countReceived(first, 50*time.Millisecond); received != 2 {
+		t.Errorf("expected 2. found %d", received)
+	}
+}
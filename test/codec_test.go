@@ -0,0 +1,291 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"github.com/ugorji/go/codec"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	codecs := map[string]proletariat.Codec{
+		"msgpack":         proletariat.MsgpackCodec{},
+		"length-prefixed": proletariat.LengthPrefixedCodec{},
+	}
+	for name, c := range codecs {
+		buffer := &bytes.Buffer{}
+		encoder, decoder := c.NewEncoder(buffer), c.NewDecoder(buffer)
+		for _, content := range []string{"Ola, Mundo!", "", "hello world"} {
+			if err := encoder.Encode(proletariat.Frame{Data: []byte(content)}); err != nil {
+				t.Fatalf("%s failed encoding. %v", name, err)
+			}
+		}
+
+		for _, content := range []string{"Ola, Mundo!", "", "hello world"} {
+			frame, err := decoder.Decode()
+			if err != nil {
+				t.Fatalf("%s failed decoding. %v", name, err)
+			}
+
+			if string(frame.Data) != content {
+				t.Errorf("%s expected %s. found %s", name, content, string(frame.Data))
+			}
+		}
+	}
+}
+
+func TestLengthPrefixedCodec_WireFormat(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	if err := (proletariat.LengthPrefixedCodec{}).NewEncoder(buffer).Encode(proletariat.Frame{Data: []byte("hello")}); err != nil {
+		t.Fatalf("failed encoding. %v", err)
+	}
+
+	expected := []byte{0, 0, 0, 33, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	if !bytes.Equal(expected, buffer.Bytes()) {
+		t.Errorf("expected %v. found %v", expected, buffer.Bytes())
+	}
+}
+
+func TestLengthPrefixedCodec_FrameTooLarge(t *testing.T) {
+	c := proletariat.LengthPrefixedCodec{MaxFrameSize: 4}
+	buffer := &bytes.Buffer{}
+	if err := c.NewEncoder(buffer).Encode(proletariat.Frame{Data: []byte("hello")}); err != proletariat.ErrFrameTooLarge {
+		t.Errorf("should fail encoding. %v", err)
+	}
+
+	if err := (proletariat.LengthPrefixedCodec{}).NewEncoder(buffer).Encode(proletariat.Frame{Data: []byte("hello")}); err != nil {
+		t.Fatalf("failed encoding. %v", err)
+	}
+
+	if _, err := c.NewDecoder(buffer).Decode(); err != proletariat.ErrFrameTooLarge {
+		t.Errorf("should fail decoding. %v", err)
+	}
+}
+
+func TestLengthPrefixedCodec_UnknownVersion(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	if err := (proletariat.LengthPrefixedCodec{}).NewEncoder(buffer).Encode(proletariat.Frame{Data: []byte("hello")}); err != nil {
+		t.Fatalf("failed encoding. %v", err)
+	}
+
+	buffer.Bytes()[4] = 2
+	if _, err := (proletariat.LengthPrefixedCodec{}).NewDecoder(buffer).Decode(); err != proletariat.ErrUnknownVersion {
+		t.Errorf("should reject the version. %v", err)
+	}
+}
+
+func TestMsgpackCodec_LegacyFrame(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	legacy := codec.NewEncoder(buffer, &codec.MsgpackHandle{})
+	if err := legacy.Encode([]byte("Ola, Mundo!")); err != nil {
+		t.Fatalf("failed encoding legacy. %v", err)
+	}
+
+	headers := map[string][]byte{"key": []byte("value")}
+	if err := (proletariat.MsgpackCodec{}).NewEncoder(buffer).Encode(proletariat.Frame{Kind: proletariat.KindRequest, ID: 42, Headers: headers, Data: []byte("hello")}); err != nil {
+		t.Fatalf("failed encoding. %v", err)
+	}
+
+	if err := legacy.Encode([]byte("hello world")); err != nil {
+		t.Fatalf("failed encoding legacy. %v", err)
+	}
+
+	expected := []proletariat.Frame{
+		{Kind: proletariat.KindMessage, Data: []byte("Ola, Mundo!")},
+		{Kind: proletariat.KindRequest, ID: 42, Headers: headers, Data: []byte("hello")},
+		{Kind: proletariat.KindMessage, Data: []byte("hello world")},
+	}
+	decoder := (proletariat.MsgpackCodec{}).NewDecoder(buffer)
+	for _, e := range expected {
+		frame, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("failed decoding. %v", err)
+		}
+
+		if !reflect.DeepEqual(e, frame) {
+			t.Errorf("expected %+v. found %+v", e, frame)
+		}
+	}
+}
+
+func TestMsgpackCodec_LegacyPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+	})
+	if err != nil {
+		t.Fatalf("failed tcp: %v", err)
+	}
+	go comm.Start()
+
+	conn, err := net.DialTimeout("tcp", comm.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed dialing. %v", err)
+	}
+
+	// Peers before frames carried headers wrote only the payload.
+	if err = codec.NewEncoder(conn, &codec.MsgpackHandle{}).Encode([]byte("Ola, Mundo!")); err != nil {
+		t.Fatalf("failed writing. %v", err)
+	}
+
+	select {
+	case msg := <-comm.Receive():
+		if msg.Data.String() != "Ola, Mundo!" {
+			t.Errorf("expected Ola, Mundo!. found %s", msg.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+
+	conn.Close()
+	cancel()
+	if err = comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestLengthPrefixedCodec_RawPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+		Codec:   proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		t.Fatalf("failed tcp: %v", err)
+	}
+	go comm.Start()
+
+	conn, err := net.DialTimeout("tcp", comm.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed dialing. %v", err)
+	}
+
+	content := []byte("Ola, Mundo!")
+	frame := make([]byte, 32+len(content))
+	binary.BigEndian.PutUint32(frame, uint32(28+len(content)))
+	frame[4] = 1
+	copy(frame[32:], content)
+	if _, err = conn.Write(frame); err != nil {
+		t.Fatalf("failed writing. %v", err)
+	}
+
+	select {
+	case msg := <-comm.Receive():
+		if msg.Data.String() != string(content) {
+			t.Errorf("expected %s. found %s", string(content), msg.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+
+	conn.Close()
+	cancel()
+	if err = comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestLengthPrefixedCodec_Communication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+		Codec:     proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		t.Fatalf("failed memory one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "second",
+		Ctx:       ctx,
+		PoolSize:  10,
+		Transport: network.NewTransport,
+		Codec:     proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		t.Fatalf("failed memory two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	sendMultipleMessages(first, second, 1024, t)
+	closePair(t, cancel, first, second)
+}
+
+func TestLengthPrefixedCodec_TimeoutWithinFrame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+		Timeout: 50 * time.Millisecond,
+		Codec:   proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		t.Fatalf("failed tcp: %v", err)
+	}
+	go comm.Start()
+
+	conn, err := net.DialTimeout("tcp", comm.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("failed dialing. %v", err)
+	}
+
+	var frames []byte
+	for _, content := range []string{"Ola, Mundo!", "hello world"} {
+		frame := make([]byte, 32+len(content))
+		binary.BigEndian.PutUint32(frame, uint32(28+len(content)))
+		frame[4] = 1
+		copy(frame[32:], content)
+		frames = append(frames, frame...)
+	}
+
+	// The read deadline expires while the first frame is incomplete.
+	for _, part := range [][]byte{frames[:2], frames[2:20], frames[20:]} {
+		if _, err = conn.Write(part); err != nil {
+			t.Fatalf("failed writing. %v", err)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	for _, content := range []string{"Ola, Mundo!", "hello world"} {
+		select {
+		case msg := <-comm.Receive():
+			if msg.Data.String() != content {
+				t.Errorf("expected %s. found %s", content, msg.Data.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving %s", content)
+		}
+	}
+
+	conn.Close()
+	cancel()
+	if err = comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
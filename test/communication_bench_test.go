@@ -19,6 +19,7 @@ import (
 	"github.com/digital-comrades/proletariat/pkg/proletariat"
 	"sync"
 	"testing"
+	"time"
 )
 
 func sendMultipleMessagesBench(first, second proletariat.Communication, content []byte, testSize int, b *testing.B) {
@@ -140,3 +141,115 @@ func Benchmark_CommunicationParallelMessages(b *testing.B) {
 
 	wg.Wait()
 }
+
+func Benchmark_CommunicationPooledMessages(b *testing.B) {
+	testSize := 1024
+	wg := &sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Timeout: 0,
+		Ctx:     ctx,
+		Codec:   proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		b.Fatalf("failed tcp one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:  "127.0.0.1:0",
+		Timeout:  0,
+		Ctx:      ctx,
+		PoolSize: 10,
+		Codec:    proletariat.LengthPrefixedCodec{},
+	})
+	if err != nil {
+		b.Fatalf("failed tcp two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for d := range first.Receive() {
+			if d.Err != nil && IsClosedError(d.Err) {
+				return
+			}
+			d.Release()
+		}
+	}()
+
+	content := []byte("hello world")
+	for i := 0; i < b.N; i++ {
+		sendMultipleMessagesBench(first, second, content, testSize, b)
+	}
+
+	cancel()
+
+	if err := first.Close(); err != nil {
+		b.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		b.Errorf("failed closing second. %s", err.Error())
+	}
+
+	wg.Wait()
+}
+
+func Benchmark_CommunicationBatchedMessages(b *testing.B) {
+	testSize := 1024
+	wg := &sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Timeout: 0,
+		Ctx:     ctx,
+	})
+	if err != nil {
+		b.Fatalf("failed tcp one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:  "127.0.0.1:0",
+		Timeout:  0,
+		Ctx:      ctx,
+		PoolSize: 10,
+		Batch:    proletariat.BatchPolicy{MaxSize: 64 << 10, Linger: time.Millisecond},
+	})
+	if err != nil {
+		b.Fatalf("failed tcp two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for d := range first.Receive() {
+			if d.Err != nil && IsClosedError(d.Err) {
+				return
+			}
+		}
+	}()
+
+	content := []byte("hello world")
+	for i := 0; i < b.N; i++ {
+		sendMultipleMessagesBench(first, second, content, testSize, b)
+	}
+
+	cancel()
+
+	if err := first.Close(); err != nil {
+		b.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		b.Errorf("failed closing second. %s", err.Error())
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestDeduplication_RetriesDeliveredOnce(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Acknowledge = true
+		configuration.Retry = proletariat.RetryPolicy{Attempts: 3, Timeout: 50 * time.Millisecond}
+		configuration.Deduplication = proletariat.Deduplication{Window: time.Minute}
+	})
+	defer closePair(t, cancel, first, second)
+
+	// Acknowledgements are lost, so the message is sent on every attempt.
+	network.SetLink("first", "second", proletariat.Link{Drop: 1})
+	if err := second.Send("first", []byte("hello")); err != proletariat.ErrNotAcknowledged {
+		t.Fatalf("should not be acknowledged. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 1 {
+		t.Errorf("expected 1. found %d", received)
+	}
+}
+
+func TestDeduplication_DuplicateAcknowledged(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Acknowledge = true
+		configuration.Retry = proletariat.RetryPolicy{Attempts: 3, Timeout: 50 * time.Millisecond}
+		configuration.Deduplication = proletariat.Deduplication{Window: time.Minute}
+	})
+	defer closePair(t, cancel, first, second)
+
+	// The first acknowledgement is lost, the retry is acknowledged without delivering again.
+	network.SetLink("first", "second", proletariat.Link{Drop: 1})
+	go func() {
+		time.Sleep(75 * time.Millisecond)
+		network.SetLink("first", "second", proletariat.Link{})
+	}()
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("should be acknowledged. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 1 {
+		t.Errorf("expected 1. found %d", received)
+	}
+}
+
+func TestDeduplication_DuplicatedByNetwork(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Deduplication = proletariat.Deduplication{Window: time.Minute}
+	})
+	defer closePair(t, cancel, first, second)
+
+	network.SetLink("second", "first", proletariat.Link{Duplicate: 1})
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 10 {
+		t.Errorf("expected 10. found %d", received)
+	}
+}
+
+func TestDeduplication_OutsideWindow(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Transport = network.NewTransport
+		configuration.Acknowledge = true
+		configuration.Retry = proletariat.RetryPolicy{Attempts: 3, Timeout: 50 * time.Millisecond}
+		configuration.Deduplication = proletariat.Deduplication{Window: 10 * time.Millisecond}
+	})
+	defer closePair(t, cancel, first, second)
+
+	// Attempts are further apart than the window, so all are delivered.
+	network.SetLink("first", "second", proletariat.Link{Drop: 1})
+	if err := second.Send("first", []byte("hello")); err != proletariat.ErrNotAcknowledged {
+		t.Fatalf("should not be acknowledged. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 3 {
+		t.Errorf("expected 3. found %d", received)
+	}
+}
+
+func TestDeduplication_SendAgainWithSameID(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Deduplication = proletariat.Deduplication{Window: time.Minute}
+	})
+	defer closePair(t, cancel, first, second)
+
+	// The caller sends again the same message, as done after a failed send.
+	for _, id := range []string{"order-1", "order-1", "order-2"} {
+		headers := map[string][]byte{proletariat.MessageIDHeader: []byte(id)}
+		if err := second.SendWithHeaders("first", headers, []byte(id)); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	receiveFrom(t, first.Receive(), "order-1", "order-2")
+}
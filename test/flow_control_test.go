@@ -0,0 +1,171 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+// Capacity of the Receive channel.
+const receiveCapacity = 1024
+
+func TestFlowControl_SenderWaitsForReceiver(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	flow := proletariat.FlowControlPolicy{Window: 8}
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:     "127.0.0.1:0",
+		Ctx:         ctx,
+		FlowControl: flow,
+	})
+	if err != nil {
+		t.Fatalf("failed first: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:     "127.0.0.1:0",
+		Ctx:         ctx,
+		Timeout:     250 * time.Millisecond,
+		FlowControl: flow,
+	})
+	if err != nil {
+		t.Fatalf("failed second: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+	defer closePair(t, cancel, first, second)
+
+	// Nothing is consumed, so once the Receive channel is full the
+	// receiver stops returning credits.
+	addr := proletariat.Address(first.Addr().String())
+	sent := 0
+	for ; sent < receiveCapacity+2*flow.Window; sent++ {
+		if err = second.Send(addr, []byte("hello")); err != nil {
+			break
+		}
+	}
+
+	if err != proletariat.ErrReceiverBusy {
+		t.Fatalf("should fail with receiver busy. %v", err)
+	}
+
+	if sent < receiveCapacity+flow.Window/2 || sent > receiveCapacity+flow.Window {
+		t.Errorf("expected around %d sent. found %d", receiveCapacity+flow.Window, sent)
+	}
+
+	// Consuming the messages returns the credits.
+	if received := countReceived(first, 100*time.Millisecond); received != sent {
+		t.Errorf("expected %d. found %d", sent, received)
+	}
+
+	if err = second.Send(addr, []byte("hello")); err != nil {
+		t.Fatalf("failed sending after consuming. %v", err)
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 1 {
+		t.Errorf("expected 1. found %d", received)
+	}
+}
+
+func TestFlowControl_DropEvent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Ctx:       ctx,
+		Timeout:   10 * time.Millisecond,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed first: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "second",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+		NodeID:    "node-second",
+	})
+	if err != nil {
+		t.Fatalf("failed second: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+	defer closePair(t, cancel, first, second)
+
+	dropped := 5
+	for i := 0; i < receiveCapacity+dropped; i++ {
+		if err = second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	for i := 1; i <= dropped; i++ {
+		select {
+		case event := <-first.DropEvents():
+			if event.From != "second" || event.Node != "node-second" {
+				t.Errorf("expected drop from second. found %#v", event)
+			}
+
+			if event.Dropped != uint64(i) {
+				t.Errorf("expected %d dropped. found %d", i, event.Dropped)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long for drop %d", i)
+		}
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != receiveCapacity {
+		t.Errorf("expected %d. found %d", receiveCapacity, received)
+	}
+}
+
+func TestFlowControl_DifferentWindows(t *testing.T) {
+	for name, receiver := range map[string]proletariat.FlowControlPolicy{
+		"disabled": {},
+		"larger":   {Window: 128},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+			ctx, cancel := context.WithCancel(context.TODO())
+			first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+				configuration.Timeout = 250 * time.Millisecond
+				configuration.FlowControl = receiver
+				if configuration.Address == "second" {
+					configuration.FlowControl = proletariat.FlowControlPolicy{Window: 4}
+				}
+			})
+			defer closePair(t, cancel, first, second)
+
+			// The receiver returns credits based on the window of the sender.
+			for i := 0; i < 64; i++ {
+				if err := second.Send("first", []byte("hello")); err != nil {
+					t.Fatalf("failed sending %d. %v", i, err)
+				}
+			}
+
+			if received := countReceived(first, 100*time.Millisecond); received != 64 {
+				t.Errorf("expected 64. found %d", received)
+			}
+		})
+	}
+}
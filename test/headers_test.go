@@ -0,0 +1,123 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"testing"
+	"time"
+)
+
+func TestHeaders_CodecRoundTrip(t *testing.T) {
+	codecs := map[string]proletariat.Codec{
+		"msgpack":         proletariat.MsgpackCodec{},
+		"length-prefixed": proletariat.LengthPrefixedCodec{},
+	}
+	headers := map[string][]byte{
+		"type":     []byte("greeting"),
+		"trace-id": {0x1, 0x2, 0x3},
+		"empty":    {},
+	}
+	for name, c := range codecs {
+		buffer := &bytes.Buffer{}
+		err := c.NewEncoder(buffer).Encode(proletariat.Frame{Headers: headers, Data: []byte("Ola, Mundo!")})
+		if err != nil {
+			t.Fatalf("%s failed encoding. %v", name, err)
+		}
+
+		frame, err := c.NewDecoder(buffer).Decode()
+		if err != nil {
+			t.Fatalf("%s failed decoding. %v", name, err)
+		}
+
+		if string(frame.Data) != "Ola, Mundo!" {
+			t.Errorf("%s expected payload. found %s", name, string(frame.Data))
+		}
+
+		if len(frame.Headers) != len(headers) {
+			t.Fatalf("%s expected %d headers. found %d", name, len(headers), len(frame.Headers))
+		}
+
+		for key, value := range headers {
+			if !bytes.Equal(value, frame.Headers[key]) {
+				t.Errorf("%s header %s expected %v. found %v", name, key, value, frame.Headers[key])
+			}
+		}
+	}
+}
+
+func TestHeaders_MalformedFrame(t *testing.T) {
+	// Declares one header with a key bigger than the frame.
+	buffer := bytes.NewBuffer([]byte{0, 0, 0, 30, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 9})
+	_, err := proletariat.LengthPrefixedCodec{}.NewDecoder(buffer).Decode()
+	if err != proletariat.ErrMalformedFrame {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestHeaders_SendWithHeaders(t *testing.T) {
+	codecs := map[string]proletariat.Codec{
+		"msgpack":         proletariat.MsgpackCodec{},
+		"length-prefixed": proletariat.LengthPrefixedCodec{},
+	}
+	for name, c := range codecs {
+		ctx, cancel := context.WithCancel(context.TODO())
+		network := proletariat.NewMemoryNetwork()
+		first, err := proletariat.NewCommunication(proletariat.Configuration{
+			Address:   "first",
+			Ctx:       ctx,
+			Transport: network.NewTransport,
+			Codec:     c,
+		})
+		if err != nil {
+			t.Fatalf("%s failed memory one: %v", name, err)
+		}
+
+		second, err := proletariat.NewCommunication(proletariat.Configuration{
+			Address:   "second",
+			Ctx:       ctx,
+			Transport: network.NewTransport,
+			Codec:     c,
+		})
+		if err != nil {
+			t.Fatalf("%s failed memory two: %v", name, err)
+		}
+
+		go first.Start()
+		go second.Start()
+
+		headers := map[string][]byte{"type": []byte("greeting")}
+		if err = second.SendWithHeaders("first", headers, []byte("Ola, Mundo!")); err != nil {
+			t.Fatalf("%s failed sending. %v", name, err)
+		}
+
+		select {
+		case msg := <-first.Receive():
+			if string(msg.Headers["type"]) != "greeting" {
+				t.Errorf("%s expected header. found %v", name, msg.Headers)
+			}
+
+			if msg.Data.String() != "Ola, Mundo!" {
+				t.Errorf("%s expected payload. found %s", name, msg.Data.String())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s took to long receiving", name)
+		}
+
+		closePair(t, cancel, first, second)
+	}
+}
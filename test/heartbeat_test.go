@@ -0,0 +1,84 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func expectPeerEvent(t *testing.T, comm proletariat.Communication, expected proletariat.PeerEvent) {
+	select {
+	case event := <-comm.PeerEvents():
+		if event != expected {
+			t.Errorf("expected %+v. found %+v", expected, event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long waiting %+v", expected)
+	}
+}
+
+func TestHeartbeat_UnknownPeer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Timeout = time.Second
+		configuration.Transport = network.NewTransport
+		configuration.Heartbeat = proletariat.HeartbeatPolicy{Interval: 20 * time.Millisecond}
+	})
+	defer closePair(t, cancel, first, second)
+
+	time.Sleep(50 * time.Millisecond)
+	if second.IsAlive("first") {
+		t.Errorf("peer never contacted should not be alive")
+	}
+}
+
+func TestHeartbeat_DownAndUp(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Timeout = time.Second
+		configuration.Transport = network.NewTransport
+		configuration.Heartbeat = proletariat.HeartbeatPolicy{Interval: 20 * time.Millisecond}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	expectPeerEvent(t, second, proletariat.PeerEvent{Address: "first", Alive: true})
+	if !second.IsAlive("first") {
+		t.Errorf("first should be alive")
+	}
+
+	// The peer that received the message also monitors the sender.
+	expectPeerEvent(t, first, proletariat.PeerEvent{Address: "second", Alive: true})
+
+	network.Partition([]proletariat.Address{"first"}, []proletariat.Address{"second"})
+	expectPeerEvent(t, second, proletariat.PeerEvent{Address: "first", Alive: false})
+	if second.IsAlive("first") {
+		t.Errorf("first should be down")
+	}
+
+	network.Heal()
+	expectPeerEvent(t, second, proletariat.PeerEvent{Address: "first", Alive: true})
+}
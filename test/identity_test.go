@@ -0,0 +1,161 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestIdentity_ReplyToSender(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	var comms []proletariat.Communication
+	for i := 0; i < 2; i++ {
+		comm, err := proletariat.NewCommunication(proletariat.Configuration{
+			Address: "127.0.0.1:0",
+			Ctx:     ctx,
+		})
+		if err != nil {
+			t.Fatalf("failed tcp: %v", err)
+		}
+		go comm.Start()
+		comms = append(comms, comm)
+	}
+	first, second := comms[0], comms[1]
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send(proletariat.Address(first.Addr().String()), []byte("ping")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	var from proletariat.Address
+	select {
+	case d := <-first.Receive():
+		from = d.From
+	case <-time.After(time.Second):
+		t.Fatalf("took to long receiving")
+	}
+
+	if from != proletariat.Address(second.Addr().String()) {
+		t.Fatalf("expected %s. found %s", second.Addr().String(), from)
+	}
+
+	if err := first.Send(from, []byte("pong")); err != nil {
+		t.Fatalf("failed replying. %v", err)
+	}
+
+	select {
+	case d := <-second.Receive():
+		if d.Data.String() != "pong" {
+			t.Errorf("expected pong. found %s", d.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestIdentity_AdvertisedAddressAndNode(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.NodeID = "node-" + string(configuration.Address)
+		configuration.Advertise = "public-" + configuration.Address
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		if d.From != "public-second" {
+			t.Errorf("expected public-second. found %s", d.From)
+		}
+
+		if d.Node != "node-second" {
+			t.Errorf("expected node-second. found %s", d.Node)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestIdentity_RequestKnowsReplier(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	go func() {
+		for d := range first.Receive() {
+			if d.From != "second" {
+				t.Errorf("expected second. found %s", d.From)
+			}
+			first.Reply(d, []byte(d.From))
+		}
+	}()
+
+	reply, err := second.Request(ctx, "first", []byte("who"))
+	if err != nil {
+		t.Fatalf("failed requesting. %v", err)
+	}
+
+	if string(reply) != "second" {
+		t.Errorf("expected second. found %s", string(reply))
+	}
+}
+
+func TestIdentity_UnverifiedAddress(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	var comms []proletariat.Communication
+	for _, advertise := range []proletariat.Address{"", "10.255.0.1:7000"} {
+		comm, err := proletariat.NewCommunication(proletariat.Configuration{
+			Address:   "127.0.0.1:0",
+			Advertise: advertise,
+			Ctx:       ctx,
+		})
+		if err != nil {
+			t.Fatalf("failed tcp: %v", err)
+		}
+		go comm.Start()
+		comms = append(comms, comm)
+	}
+	first, second := comms[0], comms[1]
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send(proletariat.Address(first.Addr().String()), []byte("ping")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		// The claimed host is not where the connection comes from.
+		if d.From == "10.255.0.1:7000" {
+			t.Errorf("unverified address should not be trusted")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long receiving")
+	}
+
+	if statistics := first.Statistics(); statistics.Idle != 0 {
+		t.Errorf("unverified connection should not be pooled. found %+v", statistics)
+	}
+}
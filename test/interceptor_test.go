@@ -0,0 +1,209 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the name of the interceptor invoked.
+func recording(mutex *sync.Mutex, calls *[]string, name string) proletariat.Interceptor {
+	return func(*proletariat.Message) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		*calls = append(*calls, name)
+		return nil
+	}
+}
+
+func encoding(message *proletariat.Message) error {
+	message.Data = []byte(base64.StdEncoding.EncodeToString(message.Data))
+	return nil
+}
+
+func decoding(message *proletariat.Message) error {
+	data, err := base64.StdEncoding.DecodeString(string(message.Data))
+	message.Data = data
+	return err
+}
+
+func TestInterceptor_ModifyInOrder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	mutex, calls := &sync.Mutex{}, []string{}
+	annotate := func(message *proletariat.Message) error {
+		message.Headers = map[string][]byte{"trace": []byte("abc")}
+		return nil
+	}
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		switch configuration.Address {
+		case "first":
+			configuration.Inbound = []proletariat.Interceptor{recording(mutex, &calls, "decode"), decoding, recording(mutex, &calls, "inbound")}
+		case "second":
+			configuration.Outbound = []proletariat.Interceptor{recording(mutex, &calls, "outbound"), annotate, encoding, recording(mutex, &calls, "encoded")}
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		if d.Data.String() != "hello" {
+			t.Errorf("expected hello. found %s", d.Data.String())
+		}
+
+		if !bytes.Equal(d.Headers["trace"], []byte("abc")) {
+			t.Errorf("expected trace header. found %v", d.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long receiving")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []string{"outbound", "encoded", "decode", "inbound"}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Errorf("expected %v. found %v", expected, calls)
+	}
+}
+
+func TestInterceptor_ModifyHeadersInPlace(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	tracing := func(message *proletariat.Message) error {
+		message.Headers["trace"] = []byte("abc")
+		return nil
+	}
+	seeing := func(message *proletariat.Message) error {
+		message.Headers["seen"] = []byte("yes")
+		return nil
+	}
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		switch configuration.Address {
+		case "first":
+			configuration.Inbound = []proletariat.Interceptor{seeing}
+		case "second":
+			configuration.Outbound = []proletariat.Interceptor{tracing}
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	headers := map[string][]byte{"user": []byte("value")}
+	if err := second.SendWithHeaders("first", headers, []byte("hello")); err != nil {
+		t.Fatalf("failed sending with headers. %v", err)
+	}
+
+	if len(headers) != 1 {
+		t.Errorf("caller headers should not change. found %v", headers)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-first.Receive():
+			if !bytes.Equal(d.Headers["trace"], []byte("abc")) || !bytes.Equal(d.Headers["seen"], []byte("yes")) {
+				t.Errorf("expected trace and seen headers. found %v", d.Headers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving")
+		}
+	}
+}
+
+func TestInterceptor_Reject(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	errUnauthorized := errors.New("unauthorized")
+	errSecret := errors.New("secret content")
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		switch configuration.Address {
+		case "first":
+			configuration.Inbound = []proletariat.Interceptor{func(message *proletariat.Message) error {
+				if _, ok := message.Headers["token"]; !ok {
+					return errUnauthorized
+				}
+				return nil
+			}}
+		case "second":
+			configuration.Outbound = []proletariat.Interceptor{func(message *proletariat.Message) error {
+				if string(message.Data) == "secret" {
+					return errSecret
+				}
+				return nil
+			}}
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	token := map[string][]byte{"token": []byte("abc")}
+	if err := second.SendWithHeaders("first", token, []byte("secret")); err != errSecret {
+		t.Errorf("should reject sending. %v", err)
+	}
+
+	if err := second.Send("first", []byte("no token")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	if _, err := second.Request(ctx, "first", []byte("no token")); !errors.Is(err, errUnauthorized) {
+		t.Errorf("should reject the request. %v", err)
+	}
+
+	if err := second.SendWithHeaders("first", token, []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "hello")
+}
+
+func TestInterceptor_RequestAndReply(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Outbound = []proletariat.Interceptor{encoding}
+		configuration.Inbound = []proletariat.Interceptor{decoding}
+	})
+	defer closePair(t, cancel, first, second)
+
+	go func() {
+		for d := range first.Receive() {
+			if err := first.Reply(d, append([]byte("echo "), d.Data.Bytes()...)); err != nil {
+				t.Errorf("failed replying. %v", err)
+			}
+		}
+	}()
+
+	reply, err := second.Request(ctx, "first", []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed requesting. %v", err)
+	}
+
+	if string(reply) != "echo hello" {
+		t.Errorf("expected echo hello. found %s", string(reply))
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport_BadAddress(t *testing.T) {
+	network := proletariat.NewMemoryNetwork()
+	_, err := network.NewTransport(context.TODO(), "")
+	if err != proletariat.ErrInvalidAddr {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestMemoryTransport_AddressInUse(t *testing.T) {
+	network := proletariat.NewMemoryNetwork()
+	transport, err := network.NewTransport(context.TODO(), "first")
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if _, err = network.NewTransport(context.TODO(), "first"); err != proletariat.ErrAddrInUse {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if err = transport.Close(); err != nil {
+		t.Fatalf("failed closing. %v", err)
+	}
+
+	if _, err = network.NewTransport(context.TODO(), "first"); err != nil {
+		t.Fatalf("address should be available after closing. %v", err)
+	}
+}
+
+func TestMemoryTransport_DialUnknownAddress(t *testing.T) {
+	network := proletariat.NewMemoryNetwork()
+	transport, err := network.NewTransport(context.TODO(), "first")
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	defer transport.Close()
+
+	if _, err = transport.Dial("second", time.Second); err == nil {
+		t.Fatalf("should fail dialing unknown address")
+	}
+}
+
+func TestMemoryTransport_AcceptAfterClose(t *testing.T) {
+	network := proletariat.NewMemoryNetwork()
+	transport, err := network.NewTransport(context.TODO(), "first")
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	transport.Close()
+	if _, err = transport.Accept(); err == nil || !IsClosedError(err) {
+		t.Fatalf("should fail accepting with closed error. %v", err)
+	}
+}
+
+func TestMemoryCommunication_SendMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed memory one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "second",
+		Ctx:       ctx,
+		PoolSize:  10,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed memory two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	sendMultipleMessages(first, second, 1024, t)
+	cancel()
+
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %s", err.Error())
+	}
+}
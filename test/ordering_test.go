@@ -0,0 +1,294 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stalls the first connection dialed after its handshake, until released.
+type stallingTransport struct {
+	proletariat.Transport
+	release chan bool
+	dials   int64
+}
+
+func (s *stallingTransport) Dial(address proletariat.Address, timeout time.Duration) (net.Conn, error) {
+	conn, err := s.Transport.Dial(address, timeout)
+	if err != nil || atomic.AddInt64(&s.dials, 1) > 1 {
+		return conn, err
+	}
+	return &stallingConn{Conn: conn, release: s.release}, nil
+}
+
+type stallingConn struct {
+	net.Conn
+	release chan bool
+	writes  int64
+}
+
+// The handshake is the first write, the message after it waits.
+func (s *stallingConn) Write(p []byte) (int, error) {
+	if atomic.AddInt64(&s.writes, 1) == 2 {
+		<-s.release
+	}
+	return s.Conn.Write(p)
+}
+
+// Creates an ordered communication and dials it twice, so frames
+// can be written out of order over different connections.
+func createOrderedReceiver(t *testing.T, ctx context.Context, policy proletariat.ReorderPolicy) (proletariat.Communication, []proletariat.Encoder) {
+	network := proletariat.NewMemoryNetwork()
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+		Codec:     proletariat.LengthPrefixedCodec{},
+		Ordered:   true,
+		Reorder:   policy,
+	})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go comm.Start()
+
+	raw, err := network.NewTransport(ctx, "raw")
+	if err != nil {
+		t.Fatalf("failed raw: %v", err)
+	}
+	defer raw.Close()
+
+	var encoders []proletariat.Encoder
+	for i := 0; i < 2; i++ {
+		conn, err := raw.Dial("first", time.Second)
+		if err != nil {
+			t.Fatalf("failed dialing. %v", err)
+		}
+		encoders = append(encoders, proletariat.LengthPrefixedCodec{}.NewEncoder(conn))
+	}
+	return comm, encoders
+}
+
+func receiveContent(t *testing.T, comm proletariat.Communication, expected string) {
+	select {
+	case d := <-comm.Receive():
+		if d.Data.String() != expected {
+			t.Errorf("expected %s. found %s", expected, d.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving %s", expected)
+	}
+}
+
+func TestOrdering_ReorderAcrossConnections(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, encoders := createOrderedReceiver(t, ctx, proletariat.ReorderPolicy{})
+
+	for _, sequence := range []uint64{3, 2} {
+		frame := proletariat.Frame{ID: sequence, Origin: 7, Sequence: sequence, Data: []byte(fmt.Sprint(sequence))}
+		if err := encoders[int(sequence)%2].Encode(frame); err != nil {
+			t.Fatalf("failed writing. %v", err)
+		}
+	}
+
+	if received := countReceived(comm, 50*time.Millisecond); received != 0 {
+		t.Fatalf("should wait for the first message. found %d", received)
+	}
+
+	if err := encoders[1].Encode(proletariat.Frame{ID: 1, Origin: 7, Sequence: 1, Data: []byte("1")}); err != nil {
+		t.Fatalf("failed writing. %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		receiveContent(t, comm, strconv.Itoa(i))
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestOrdering_SkipMissingAfterTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, encoders := createOrderedReceiver(t, ctx, proletariat.ReorderPolicy{Timeout: 50 * time.Millisecond})
+
+	if err := encoders[0].Encode(proletariat.Frame{ID: 2, Origin: 7, Sequence: 2, Data: []byte("2")}); err != nil {
+		t.Fatalf("failed writing. %v", err)
+	}
+	receiveContent(t, comm, "2")
+
+	// Arrived after the receiver stopped waiting.
+	if err := encoders[1].Encode(proletariat.Frame{ID: 1, Origin: 7, Sequence: 1, Data: []byte("1")}); err != nil {
+		t.Fatalf("failed writing. %v", err)
+	}
+	if received := countReceived(comm, 50*time.Millisecond); received != 0 {
+		t.Errorf("late message should be discarded. found %d", received)
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestOrdering_SkipMissingWhenFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, encoders := createOrderedReceiver(t, ctx, proletariat.ReorderPolicy{Timeout: time.Minute, Capacity: 2})
+
+	for _, sequence := range []uint64{2, 3, 4} {
+		frame := proletariat.Frame{ID: sequence, Origin: 7, Sequence: sequence, Data: []byte(fmt.Sprint(sequence))}
+		if err := encoders[0].Encode(frame); err != nil {
+			t.Fatalf("failed writing. %v", err)
+		}
+	}
+
+	for i := 2; i <= 4; i++ {
+		receiveContent(t, comm, strconv.Itoa(i))
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestOrdering_SendInOrder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Ordered = true
+	})
+	defer closePair(t, cancel, first, second)
+
+	for i := 0; i < 100; i++ {
+		if err := second.Send("first", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		receiveContent(t, first, strconv.Itoa(i))
+	}
+}
+
+func TestOrdering_FailedSendKeepsSequence(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Ordered = true
+		configuration.Codec = proletariat.LengthPrefixedCodec{MaxFrameSize: 64}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", make([]byte, 128)); err == nil {
+		t.Fatalf("should fail sending a large message")
+	}
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// The refused message is skipped, so the receiver does not wait the timeout.
+	select {
+	case d := <-first.Receive():
+		if d.Data.String() != "hello" {
+			t.Errorf("expected hello. found %s", d.Data.String())
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestOrdering_ForgetIdleSenders(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	comm, encoders := createOrderedReceiver(t, ctx, proletariat.ReorderPolicy{Senders: 1})
+
+	for _, origin := range []uint64{7, 8, 7} {
+		frame := proletariat.Frame{ID: origin, Origin: origin, Sequence: 1, Data: []byte(fmt.Sprint(origin))}
+		if err := encoders[0].Encode(frame); err != nil {
+			t.Fatalf("failed writing. %v", err)
+		}
+		// The first sender was forgotten, so its message is not discarded.
+		receiveContent(t, comm, fmt.Sprint(origin))
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestOrdering_SendsNotSerialized(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	release := make(chan bool)
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Ordered = true
+		if configuration.Address == "second" {
+			factory := configuration.Transport
+			configuration.Transport = func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+				transport, err := factory(ctx, address)
+				return &stallingTransport{Transport: transport, release: release}, err
+			}
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	stalled := make(chan error, 1)
+	go func() {
+		stalled <- second.Send("first", []byte("one"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The second message is written over another connection meanwhile.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- second.Send("first", []byte("two"))
+	}()
+
+	waited := false
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("failed sending. %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		waited = true
+		t.Errorf("ordered sends should not wait for each other")
+	}
+
+	close(release)
+	if waited {
+		<-sent
+	}
+
+	if err := <-stalled; err != nil {
+		t.Errorf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "one", "two")
+}
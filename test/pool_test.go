@@ -0,0 +1,111 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func TestPool_ReuseConnection(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	statistics := second.Statistics()
+	if statistics.Dialed != 1 || statistics.Reused != 9 {
+		t.Errorf("expected 1 dialed and 9 reused. found %+v", statistics)
+	}
+
+	if statistics.Open != 1 || statistics.Idle != 1 {
+		t.Errorf("expected 1 open and idle. found %+v", statistics)
+	}
+
+	if !Eventually(func() bool { return first.Statistics().Accepted == 1 }, time.Second) {
+		t.Errorf("expected 1 accepted. found %+v", first.Statistics())
+	}
+}
+
+func TestPool_CloseIdleConnections(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Pool = proletariat.PoolPolicy{IdleTimeout: 50 * time.Millisecond, ReapInterval: 10 * time.Millisecond}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// Both sides pool the shared connection, whichever reaps it first
+	// closes it and the other notices.
+	idleClosed := func() uint64 {
+		return first.Statistics().IdleClosed + second.Statistics().IdleClosed
+	}
+	if !Eventually(func() bool { return idleClosed() >= 1 }, time.Second) {
+		t.Fatalf("idle connection should be closed. found %+v and %+v", first.Statistics(), second.Statistics())
+	}
+
+	if !Eventually(func() bool { return first.Statistics().Open == 0 && second.Statistics().Open == 0 }, time.Second) {
+		t.Fatalf("expected no connections. found %+v and %+v", first.Statistics(), second.Statistics())
+	}
+
+	if statistics := second.Statistics(); statistics.Idle != 0 {
+		t.Errorf("expected no idle connections. found %+v", statistics)
+	}
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending again. %v", err)
+	}
+
+	if dialed := second.Statistics().Dialed; dialed != 2 {
+		t.Errorf("expected 2 dialed. found %d", dialed)
+	}
+}
+
+func TestPool_MaxLifetime(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Pool = proletariat.PoolPolicy{MaxLifetime: 100 * time.Millisecond, ReapInterval: time.Hour}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// The pooled connection expires without the reaper running.
+	time.Sleep(150 * time.Millisecond)
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending again. %v", err)
+	}
+
+	statistics := second.Statistics()
+	if statistics.Dialed != 2 || statistics.Expired != 1 {
+		t.Errorf("expected 2 dialed and 1 expired. found %+v", statistics)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func publishNumbered(channel *proletariat.SharedChannel, ctx context.Context, amount int) int {
+	published := 0
+	for i := 0; i < amount; i++ {
+		if channel.Publish(ctx, proletariat.Datagram{Data: bytes.NewBufferString(fmt.Sprint(i))}) {
+			published++
+		}
+	}
+	return published
+}
+
+func consumeNumbered(t *testing.T, channel *proletariat.SharedChannel, expected ...int) {
+	for _, number := range expected {
+		select {
+		case d := <-channel.Consume():
+			if d.Data.String() != fmt.Sprint(number) {
+				t.Errorf("expected %d. found %s", number, d.Data.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long consuming %d", number)
+		}
+	}
+}
+
+func TestSharedChannel_OverflowBlock(t *testing.T) {
+	channel := proletariat.NewSharedChannelWithPolicy(proletariat.ReceivePolicy{Capacity: 2})
+	defer channel.Close()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if published := publishNumbered(channel, ctx, 3); published != 2 {
+		t.Errorf("expected 2 published. found %d", published)
+	}
+
+	// A cancelled context is not counted as a drop.
+	cancelled, stop := context.WithCancel(context.TODO())
+	stop()
+	if channel.Publish(cancelled, proletariat.Datagram{Data: bytes.NewBufferString("cancelled")}) {
+		t.Errorf("should not publish with context cancelled")
+	}
+
+	expected := proletariat.ReceiveStatistics{Published: 2, Dropped: 1}
+	if statistics := channel.Statistics(); statistics != expected {
+		t.Errorf("expected %#v. found %#v", expected, statistics)
+	}
+	consumeNumbered(t, channel, 0, 1)
+}
+
+func TestSharedChannel_OverflowDropNewest(t *testing.T) {
+	channel := proletariat.NewSharedChannelWithPolicy(proletariat.ReceivePolicy{Capacity: 2, Overflow: proletariat.OverflowDropNewest})
+	defer channel.Close()
+
+	if published := publishNumbered(channel, context.TODO(), 5); published != 2 {
+		t.Errorf("expected 2 published. found %d", published)
+	}
+
+	expected := proletariat.ReceiveStatistics{Published: 2, Dropped: 3}
+	if statistics := channel.Statistics(); statistics != expected {
+		t.Errorf("expected %#v. found %#v", expected, statistics)
+	}
+	consumeNumbered(t, channel, 0, 1)
+}
+
+func TestSharedChannel_OverflowDropOldest(t *testing.T) {
+	channel := proletariat.NewSharedChannelWithPolicy(proletariat.ReceivePolicy{Capacity: 2, Overflow: proletariat.OverflowDropOldest})
+	defer channel.Close()
+
+	if published := publishNumbered(channel, context.TODO(), 5); published != 5 {
+		t.Errorf("expected 5 published. found %d", published)
+	}
+
+	expected := proletariat.ReceiveStatistics{Published: 5, Evicted: 3}
+	if statistics := channel.Statistics(); statistics != expected {
+		t.Errorf("expected %#v. found %#v", expected, statistics)
+	}
+	consumeNumbered(t, channel, 3, 4)
+}
+
+func TestSharedChannel_OverflowSpill(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	channel := proletariat.NewSharedChannelWithPolicy(proletariat.ReceivePolicy{Capacity: 2, Overflow: proletariat.OverflowSpill})
+
+	if published := publishNumbered(channel, context.TODO(), 100); published != 100 {
+		t.Errorf("expected 100 published. found %d", published)
+	}
+
+	expected := proletariat.ReceiveStatistics{Published: 100, Spilled: 98}
+	if statistics := channel.Statistics(); statistics != expected {
+		t.Errorf("expected %#v. found %#v", expected, statistics)
+	}
+
+	var numbers []int
+	for i := 0; i < 100; i++ {
+		numbers = append(numbers, i)
+	}
+	consumeNumbered(t, channel, numbers...)
+
+	// Closing with messages still spilled stops moving them.
+	publishNumbered(channel, context.TODO(), 10)
+	if err := channel.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestReceivePolicy_Communication(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+		Receive:   proletariat.ReceivePolicy{Capacity: 10, Overflow: proletariat.OverflowDropNewest},
+	})
+	if err != nil {
+		t.Fatalf("failed first: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "second",
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed second: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+	defer closePair(t, cancel, first, second)
+
+	for i := 0; i < 15; i++ {
+		if err = second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	// The last message is dropped after the send returns.
+	if !Eventually(func() bool { return first.ReceiveStatistics().Dropped == 5 }, time.Second) {
+		t.Fatalf("expected 5 dropped. found %#v", first.ReceiveStatistics())
+	}
+
+	for i := 1; i <= 5; i++ {
+		select {
+		case event := <-first.DropEvents():
+			if event.From != "second" || event.Dropped != uint64(i) {
+				t.Errorf("expected drop %d from second. found %#v", i, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long for drop %d", i)
+		}
+	}
+
+	if received := countReceived(first, 100*time.Millisecond); received != 10 {
+		t.Errorf("expected 10. found %d", received)
+	}
+}
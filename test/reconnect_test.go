@@ -0,0 +1,245 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Clock that only moves when advanced.
+type fakeClock struct {
+	mutex *sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{mutex: &sync.Mutex{}, now: time.Unix(0, 0)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(duration time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(duration)
+}
+
+func createBackoffCommunication(t *testing.T, ctx context.Context, network *proletariat.MemoryNetwork, clock proletariat.Clock, policy proletariat.ReconnectPolicy) (proletariat.Communication, *countingTransport) {
+	counting := &countingTransport{}
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "second",
+		Ctx:     ctx,
+		Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			transport, err := network.NewTransport(ctx, address)
+			counting.Transport = transport
+			return counting, err
+		},
+		Reconnect: policy,
+		Clock:     clock,
+	})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go comm.Start()
+	return comm, counting
+}
+
+func TestReconnect_ExponentialBackoff(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	policy := proletariat.ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	comm, counting := createBackoffCommunication(t, ctx, network, clock, policy)
+
+	// Expected wait after each consecutive failure.
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if err := comm.Send("first", []byte("hello")); err == nil || err == proletariat.ErrPeerBackoff {
+			t.Fatalf("should fail dialing. %v", err)
+		}
+
+		dials := atomic.LoadInt64(&counting.dials)
+		clock.Advance(backoff - time.Millisecond)
+		if err := comm.Send("first", []byte("hello")); err != proletariat.ErrPeerBackoff {
+			t.Fatalf("should fail while cooling down. %v", err)
+		}
+
+		if atomic.LoadInt64(&counting.dials) != dials {
+			t.Fatalf("should not dial while cooling down")
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestReconnect_ResetAfterConnecting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	comm, _ := createBackoffCommunication(t, ctx, network, clock, proletariat.ReconnectPolicy{InitialBackoff: time.Second})
+
+	for i := 0; i < 3; i++ {
+		comm.Send("first", []byte("hello"))
+		clock.Advance(time.Hour)
+	}
+
+	first, err := proletariat.NewCommunication(proletariat.Configuration{Address: "first", Ctx: ctx, Transport: network.NewTransport})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go first.Start()
+	defer closePair(t, cancel, first, comm)
+
+	if err = comm.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// The backoff starts again from the initial wait.
+	if err = first.Close(); err != nil {
+		t.Fatalf("failed closing. %v", err)
+	}
+	failed := Eventually(func() bool {
+		return comm.Send("first", []byte("hello")) != nil
+	}, time.Second)
+	if !failed {
+		t.Fatalf("should fail after the peer closed")
+	}
+
+	clock.Advance(time.Second)
+	if err = comm.Send("first", []byte("hello")); err == proletariat.ErrPeerBackoff {
+		t.Errorf("should dial again after the initial wait")
+	}
+}
+
+func TestReconnect_Jitter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	policy := proletariat.ReconnectPolicy{InitialBackoff: time.Second, Multiplier: 1, Jitter: 0.5}
+	comm, counting := createBackoffCommunication(t, ctx, network, clock, policy)
+
+	var waits []time.Duration
+	for i := 0; i < 10; i++ {
+		comm.Send("first", []byte("hello"))
+		dials := atomic.LoadInt64(&counting.dials)
+
+		// Find the wait with a resolution of 10ms.
+		var waited time.Duration
+		for atomic.LoadInt64(&counting.dials) == dials {
+			clock.Advance(10 * time.Millisecond)
+			waited += 10 * time.Millisecond
+			comm.Send("first", []byte("hello"))
+		}
+
+		if waited < 500*time.Millisecond || waited > 1510*time.Millisecond {
+			t.Errorf("wait %v outside the jitter", waited)
+		}
+		waits = append(waits, waited)
+	}
+
+	varied := false
+	for _, wait := range waits {
+		varied = varied || wait != waits[0]
+	}
+	if !varied {
+		t.Errorf("waits should vary. found %v", waits)
+	}
+
+	cancel()
+	if err := comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
+
+func TestReconnect_SingleDialAfterBackoff(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewMemoryNetwork()
+	clock := newFakeClock()
+	release := make(chan bool)
+	counting := &countingTransport{}
+	comm, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "second",
+		Ctx:     ctx,
+		Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			transport, err := network.NewTransport(ctx, address)
+			counting.Transport = &blockingTransport{Transport: transport, release: release}
+			return counting, err
+		},
+		Reconnect: proletariat.ReconnectPolicy{InitialBackoff: time.Second},
+		Clock:     clock,
+	})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go comm.Start()
+
+	dialing := func() <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- comm.Send("first", []byte("hello"))
+		}()
+		return result
+	}
+
+	first := dialing()
+	release <- true
+	if err = <-first; err == nil || err == proletariat.ErrPeerBackoff {
+		t.Fatalf("should fail dialing. %v", err)
+	}
+
+	clock.Advance(time.Second)
+	probe := dialing()
+	if !Eventually(func() bool { return atomic.LoadInt64(&counting.dials) == 2 }, time.Second) {
+		t.Fatalf("should dial after the wait")
+	}
+
+	// Others fail fast while the single attempt is dialing.
+	for i := 0; i < 5; i++ {
+		if err = comm.Send("first", []byte("hello")); err != proletariat.ErrPeerBackoff {
+			t.Errorf("should fail while dialing. %v", err)
+		}
+	}
+
+	release <- true
+	if err = <-probe; err == nil || err == proletariat.ErrPeerBackoff {
+		t.Errorf("probe should fail dialing. %v", err)
+	}
+
+	if dials := atomic.LoadInt64(&counting.dials); dials != 2 {
+		t.Errorf("expected 2 dials. found %d", dials)
+	}
+
+	cancel()
+	if err = comm.Close(); err != nil {
+		t.Errorf("failed closing. %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createMemoryPair(t *testing.T, ctx context.Context, configure func(*proletariat.Configuration)) (proletariat.Communication, proletariat.Communication) {
+	network := proletariat.NewMemoryNetwork()
+	configurations := []proletariat.Configuration{
+		{Address: "first", Ctx: ctx, Transport: network.NewTransport},
+		{Address: "second", Ctx: ctx, Transport: network.NewTransport, PoolSize: 10},
+	}
+
+	var comms []proletariat.Communication
+	for _, configuration := range configurations {
+		if configure != nil {
+			configure(&configuration)
+		}
+		comm, err := proletariat.NewCommunication(configuration)
+		if err != nil {
+			t.Fatalf("failed memory %s: %v", configuration.Address, err)
+		}
+		go comm.Start()
+		comms = append(comms, comm)
+	}
+	return comms[0], comms[1]
+}
+
+// Replies every request with the received data prefixed.
+func echo(t *testing.T, comm proletariat.Communication, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for d := range comm.Receive() {
+		if !d.IsRequest() {
+			continue
+		}
+
+		if err := comm.Reply(d, append([]byte("echo "), d.Data.Bytes()...)); err != nil {
+			t.Errorf("failed replying. %v", err)
+		}
+	}
+}
+
+func TestRequest_ReplyConcurrentRequests(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go echo(t, first, wg)
+
+	requests := &sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		requests.Add(1)
+		go func(i int) {
+			defer requests.Done()
+			timeout, done := context.WithTimeout(context.TODO(), time.Second)
+			defer done()
+
+			content := fmt.Sprintf("request %d", i)
+			response, err := second.Request(timeout, "first", []byte(content))
+			if err != nil {
+				t.Errorf("failed requesting. %v", err)
+				return
+			}
+
+			if string(response) != "echo "+content {
+				t.Errorf("expected echo %s. found %s", content, string(response))
+			}
+		}(i)
+	}
+
+	requests.Wait()
+	closePair(t, cancel, first, second)
+	wg.Wait()
+}
+
+func TestRequest_Timeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	timeout, done := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer done()
+	if _, err := second.Request(timeout, "first", []byte("hello")); err != context.DeadlineExceeded {
+		t.Fatalf("should timeout. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		if !d.IsRequest() {
+			t.Errorf("should receive a request")
+		}
+
+		// Replying after the requester gave up does not fail.
+		if err := first.Reply(d, []byte("late")); err != nil {
+			t.Errorf("failed replying. %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestRequest_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	requestCtx, requestCancel := context.WithCancel(context.TODO())
+	go func() {
+		<-first.Receive()
+		requestCancel()
+	}()
+
+	if _, err := second.Request(requestCtx, "first", []byte("hello")); err != context.Canceled {
+		t.Fatalf("should be canceled. %v", err)
+	}
+}
+
+func TestRequest_ReplyNotRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		if err := first.Reply(d, []byte("reply")); err != proletariat.ErrNotRequest {
+			t.Errorf("should fail replying. %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+
+	if err := first.Reply(proletariat.Datagram{}, nil); err != proletariat.ErrNotRequest {
+		t.Errorf("should fail replying. %v", err)
+	}
+}
+
+func TestRequest_ReplyNilError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	response := make(chan error, 1)
+	go func() {
+		_, err := second.Request(ctx, "first", []byte("hello"))
+		response <- err
+	}()
+
+	select {
+	case d := <-first.Receive():
+		if err := first.ReplyError(d, nil); err != proletariat.ErrMissingError {
+			t.Errorf("should fail replying a nil error. %v", err)
+		}
+
+		if err := first.ReplyError(d, errors.New("failed")); err != nil {
+			t.Errorf("failed replying. %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long receiving")
+	}
+
+	var remote *proletariat.RemoteError
+	if err := <-response; !errors.As(err, &remote) || remote.Message != "failed" {
+		t.Errorf("should fail with the replied error. %v", err)
+	}
+}
+
+func TestRequest_OverTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+	})
+	if err != nil {
+		t.Fatalf("failed tcp one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+	})
+	if err != nil {
+		t.Fatalf("failed tcp two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go echo(t, first, wg)
+
+	timeout, done := context.WithTimeout(context.TODO(), time.Second)
+	defer done()
+	response, err := second.Request(timeout, proletariat.Address(first.Addr().String()), []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed requesting. %v", err)
+	}
+
+	if string(response) != "echo hello" {
+		t.Errorf("expected echo hello. found %s", string(response))
+	}
+
+	closePair(t, cancel, first, second)
+	wg.Wait()
+}
+
+// Transport whose peers never answer, dials fail once the timeout
+// expires. Without a timeout, dials take a long time to fail.
+type unresponsiveTransport struct {
+	proletariat.Transport
+}
+
+func (u *unresponsiveTransport) Dial(_ proletariat.Address, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	time.Sleep(timeout)
+	return nil, errors.New("unreachable")
+}
+
+func TestRequest_CanceledBeforeWriting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	requestCtx, requestCancel := context.WithCancel(context.TODO())
+	requestCancel()
+	if _, err := second.Request(requestCtx, "first", []byte("hello")); err != context.Canceled {
+		t.Fatalf("should be canceled. %v", err)
+	}
+
+	if received := countReceived(first, 50*time.Millisecond); received != 0 {
+		t.Errorf("should not write the request. found %d", received)
+	}
+}
+
+func TestRequest_DeadlineWhileDialing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		factory := configuration.Transport
+		configuration.Transport = func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			transport, err := factory(ctx, address)
+			return &unresponsiveTransport{Transport: transport}, err
+		}
+	})
+	defer closePair(t, cancel, first, second)
+
+	timeout, done := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer done()
+	start := time.Now()
+	if _, err := second.Request(timeout, "first", []byte("hello")); err == nil {
+		t.Fatalf("should fail dialing")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial should be bounded by the deadline. took %s", elapsed)
+	}
+}
+
+func TestRequest_DeadlineWhileWaitingCredits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Receive = proletariat.ReceivePolicy{Capacity: 1, Overflow: proletariat.OverflowBlock}
+		configuration.FlowControl = proletariat.FlowControlPolicy{Window: 1}
+	})
+	defer closePair(t, cancel, first, second)
+
+	// The second message is not handled while the first is not consumed,
+	// so its credit is not returned.
+	for i := 0; i < 2; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		timeout, done := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+		defer done()
+		_, err := second.Request(timeout, "first", []byte("hello"))
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("should timeout. %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request should not wait after the deadline")
+	}
+}
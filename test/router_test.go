@@ -0,0 +1,192 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func typed(messageType string) map[string][]byte {
+	return map[string][]byte{proletariat.MessageTypeHeader: []byte(messageType)}
+}
+
+// Starts the router, returning the function to close it and wait.
+func startRouter(t *testing.T, router *proletariat.Router) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.Start()
+	}()
+	return func() {
+		if err := router.Close(); err != nil {
+			t.Errorf("failed closing router. %v", err)
+		}
+		<-done
+	}
+}
+
+func TestRouter_DispatchByType(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	router, err := proletariat.NewRouter(first, proletariat.RouterPolicy{Workers: 2})
+	if err != nil {
+		t.Fatalf("failed creating router. %v", err)
+	}
+
+	notified := make(chan string, 1)
+	router.HandleFunc("upper", func(d proletariat.Datagram) ([]byte, error) {
+		return []byte(strings.ToUpper(d.Data.String())), nil
+	})
+	router.HandleFunc("notify", func(d proletariat.Datagram) ([]byte, error) {
+		notified <- d.Data.String()
+		return nil, nil
+	})
+	defer startRouter(t, router)()
+
+	reply, err := second.RequestWithHeaders(ctx, "first", typed("upper"), []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed requesting. %v", err)
+	}
+
+	if string(reply) != "HELLO" {
+		t.Errorf("expected HELLO. found %s", string(reply))
+	}
+
+	if err = second.SendWithHeaders("first", typed("notify"), []byte("world")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case content := <-notified:
+		if content != "world" {
+			t.Errorf("expected world. found %s", content)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long handling")
+	}
+
+	// Messages without a type are not handled by the router.
+	if err = second.Send("first", []byte("untyped")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "untyped")
+
+	// Nor are the messages with a type header of their own.
+	if err = second.SendWithHeaders("first", map[string][]byte{"type": []byte("upper")}, []byte("own")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "own")
+}
+
+func TestRouter_Errors(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	failures := make(chan error, 1)
+	router, err := proletariat.NewRouter(first, proletariat.RouterPolicy{
+		Errors: func(_ proletariat.Datagram, err error) {
+			failures <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed creating router. %v", err)
+	}
+
+	router.HandleFunc("fail", func(proletariat.Datagram) ([]byte, error) {
+		return nil, errors.New("handler failed")
+	})
+	defer startRouter(t, router)()
+
+	_, err = second.RequestWithHeaders(ctx, "first", typed("missing"), []byte("hello"))
+	if !errors.Is(err, proletariat.ErrUnknownType) {
+		t.Errorf("should fail with unknown type. %v", err)
+	}
+
+	_, err = second.RequestWithHeaders(ctx, "first", typed("fail"), []byte("hello"))
+	var remote *proletariat.RemoteError
+	if !errors.As(err, &remote) || remote.Message != "handler failed" {
+		t.Errorf("should fail with the handler error. %v", err)
+	}
+
+	// Errors of messages that are not requests can not be replied.
+	if err = second.SendWithHeaders("first", typed("missing"), []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case err = <-failures:
+		if err != proletariat.ErrUnknownType {
+			t.Errorf("expected unknown type. found %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long handling")
+	}
+}
+
+func TestRouter_BoundedWorkers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	workers := 2
+	router, err := proletariat.NewRouter(first, proletariat.RouterPolicy{Workers: workers})
+	if err != nil {
+		t.Fatalf("failed creating router. %v", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	running, maximum := int64(0), int64(0)
+	router.HandleFunc("slow", func(proletariat.Datagram) ([]byte, error) {
+		defer wg.Done()
+		current := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			previous := atomic.LoadInt64(&maximum)
+			if current <= previous || atomic.CompareAndSwapInt64(&maximum, previous, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	})
+	defer startRouter(t, router)()
+
+	messages := 10
+	wg.Add(messages)
+	for i := 0; i < messages; i++ {
+		if err = second.SendWithHeaders("first", typed("slow"), []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+	wg.Wait()
+
+	if found := atomic.LoadInt64(&maximum); found != int64(workers) {
+		t.Errorf("expected %d handling concurrently. found %d", workers, found)
+	}
+}
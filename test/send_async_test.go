@@ -0,0 +1,202 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Transport that only dials after released, so writers are kept busy.
+type blockingTransport struct {
+	proletariat.Transport
+	release chan bool
+}
+
+func (b *blockingTransport) Dial(address proletariat.Address, timeout time.Duration) (net.Conn, error) {
+	<-b.release
+	return b.Transport.Dial(address, timeout)
+}
+
+func createBlockedPair(t *testing.T, ctx context.Context, policy proletariat.AsyncPolicy) (proletariat.Communication, proletariat.Communication, chan bool) {
+	network := proletariat.NewMemoryNetwork()
+	first, err := proletariat.NewCommunication(proletariat.Configuration{Address: "first", Ctx: ctx, Transport: network.NewTransport})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+
+	release := make(chan bool)
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "second",
+		Ctx:     ctx,
+		Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			transport, err := network.NewTransport(ctx, address)
+			return &blockingTransport{Transport: transport, release: release}, err
+		},
+		Async: policy,
+	})
+	if err != nil {
+		t.Fatalf("failed memory: %v", err)
+	}
+	go first.Start()
+	go second.Start()
+	return first, second, release
+}
+
+// Queue messages while the writer is blocked on the first one.
+func fillQueue(comm proletariat.Communication, amount int) []<-chan error {
+	results := []<-chan error{comm.SendAsync("first", []byte("0"))}
+	time.Sleep(10 * time.Millisecond)
+	for i := 1; i < amount; i++ {
+		results = append(results, comm.SendAsync("first", []byte(strconv.Itoa(i))))
+	}
+	return results
+}
+
+func expectResult(t *testing.T, result <-chan error, expected error) {
+	select {
+	case err := <-result:
+		if err != expected {
+			t.Errorf("expected %v. found %v", expected, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long waiting %v", expected)
+	}
+}
+
+func TestSendAsync_DeliveredInOrder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	var results []<-chan error
+	for i := 0; i < 100; i++ {
+		results = append(results, second.SendAsync("first", []byte(strconv.Itoa(i))))
+	}
+
+	for _, result := range results {
+		expectResult(t, result, nil)
+	}
+
+	for i := 0; i < 100; i++ {
+		receiveContent(t, first, strconv.Itoa(i))
+	}
+}
+
+func TestSendAsync_ErrorWhenFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second, release := createBlockedPair(t, ctx, proletariat.AsyncPolicy{QueueSize: 2, Full: proletariat.QueueError})
+	defer closePair(t, cancel, first, second)
+
+	results := fillQueue(second, 4)
+	expectResult(t, results[3], proletariat.ErrQueueFull)
+
+	close(release)
+	for _, result := range results[:3] {
+		expectResult(t, result, nil)
+	}
+}
+
+func TestSendAsync_DropOldestWhenFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second, release := createBlockedPair(t, ctx, proletariat.AsyncPolicy{QueueSize: 2, Full: proletariat.QueueDropOldest})
+	defer closePair(t, cancel, first, second)
+
+	results := fillQueue(second, 4)
+	expectResult(t, results[1], proletariat.ErrMessageDropped)
+
+	close(release)
+	for _, i := range []int{0, 2, 3} {
+		expectResult(t, results[i], nil)
+		receiveContent(t, first, strconv.Itoa(i))
+	}
+}
+
+func TestSendAsync_BlockWhenFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second, release := createBlockedPair(t, ctx, proletariat.AsyncPolicy{QueueSize: 2})
+	defer closePair(t, cancel, first, second)
+
+	results := fillQueue(second, 3)
+	enqueued := make(chan (<-chan error), 1)
+	go func() {
+		enqueued <- second.SendAsync("first", []byte("3"))
+	}()
+
+	select {
+	case <-enqueued:
+		t.Fatalf("should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	results = append(results, <-enqueued)
+	for _, result := range results {
+		expectResult(t, result, nil)
+	}
+}
+
+func TestSendAsync_CompletedWhenClosed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second, release := createBlockedPair(t, ctx, proletariat.AsyncPolicy{QueueSize: 2})
+	results := fillQueue(second, 3)
+
+	cancel()
+	close(release)
+	for _, result := range results[1:] {
+		expectResult(t, result, proletariat.ErrAlreadyClosed)
+	}
+	expectResult(t, second.SendAsync("first", []byte("hello")), proletariat.ErrAlreadyClosed)
+	closePair(t, cancel, first, second)
+}
+
+func TestSendAsync_RemoveIdleQueues(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		configuration.Async = proletariat.AsyncPolicy{Writers: 4, IdleTimeout: 50 * time.Millisecond}
+	})
+	defer closePair(t, cancel, first, second)
+
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	// Only the writers of the queue are started after connecting.
+	connected := goleak.IgnoreCurrent()
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			expectResult(t, second.SendAsync("first", []byte(strconv.Itoa(i))), nil)
+		}
+
+		if err := goleak.Find(connected); err != nil {
+			t.Fatalf("writers of the idle queue should stop. %v", err)
+		}
+	}
+
+	if received := countReceived(first, 50*time.Millisecond); received != 21 {
+		t.Errorf("expected 21. found %d", received)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Creates a pair over TCP, counting the connections each one dials.
+func createCountingPair(t *testing.T, ctx context.Context) (proletariat.Communication, proletariat.Communication, []*countingTransport) {
+	var comms []proletariat.Communication
+	var counters []*countingTransport
+	for i := 0; i < 2; i++ {
+		counting := &countingTransport{}
+		comm, err := proletariat.NewCommunication(proletariat.Configuration{
+			Address: "127.0.0.1:0",
+			Ctx:     ctx,
+			Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+				tcp, err := proletariat.NewTCPTransport(ctx, address)
+				if err != nil {
+					return nil, err
+				}
+				counting.Transport = tcp
+				return counting, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed tcp: %v", err)
+		}
+		go comm.Start()
+		comms = append(comms, comm)
+		counters = append(counters, counting)
+	}
+	return comms[0], comms[1], counters
+}
+
+func TestSharedConnection_ReplyOverIncoming(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second, counters := createCountingPair(t, ctx)
+	defer closePair(t, cancel, first, second)
+
+	for i := 0; i < 10; i++ {
+		if err := second.Send(proletariat.Address(first.Addr().String()), []byte("ping")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+
+		var from proletariat.Address
+		select {
+		case d := <-first.Receive():
+			from = d.From
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving")
+		}
+
+		if err := first.Send(from, []byte("pong")); err != nil {
+			t.Fatalf("failed replying. %v", err)
+		}
+
+		select {
+		case <-second.Receive():
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving")
+		}
+	}
+
+	if dials := atomic.LoadInt64(&counters[0].dials); dials != 0 {
+		t.Errorf("should reply over the incoming connection. dialed %d", dials)
+	}
+
+	if dials := atomic.LoadInt64(&counters[1].dials); dials != 1 {
+		t.Errorf("expected 1 dial. found %d", dials)
+	}
+}
+
+func TestSharedConnection_RequestsBothWays(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go echo(t, first, wg)
+	go echo(t, second, wg)
+
+	// Opens the connection, so both directions share it.
+	if _, err := second.Request(ctx, "first", []byte("hello")); err != nil {
+		t.Fatalf("failed requesting. %v", err)
+	}
+
+	request := func(comm proletariat.Communication, address proletariat.Address, requests *sync.WaitGroup) {
+		defer requests.Done()
+		reply, err := comm.Request(ctx, address, []byte("hello"))
+		if err != nil {
+			t.Errorf("failed requesting %s. %v", address, err)
+			return
+		}
+
+		if string(reply) != "echo hello" {
+			t.Errorf("expected echo hello. found %s", string(reply))
+		}
+	}
+
+	requests := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		requests.Add(2)
+		go request(first, "second", requests)
+		go request(second, "first", requests)
+	}
+	requests.Wait()
+	closePair(t, cancel, first, second)
+	wg.Wait()
+}
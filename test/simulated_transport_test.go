@@ -0,0 +1,237 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func createSimulatedPair(t *testing.T, ctx context.Context, network *proletariat.SimulatedNetwork) (proletariat.Communication, proletariat.Communication) {
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "first",
+		Timeout:   time.Second,
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed simulated one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "second",
+		Timeout:   time.Second,
+		Ctx:       ctx,
+		Transport: network.NewTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed simulated two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+	return first, second
+}
+
+func closePair(t *testing.T, cancel context.CancelFunc, first, second proletariat.Communication) {
+	cancel()
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %s", err.Error())
+	}
+}
+
+func countReceived(comm proletariat.Communication, wait time.Duration) int {
+	received := 0
+	for {
+		select {
+		case <-comm.Receive():
+			received++
+		case <-time.After(wait):
+			return received
+		}
+	}
+}
+
+func TestSimulatedNetwork_Partition(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createSimulatedPair(t, ctx, network)
+	defer closePair(t, cancel, first, second)
+
+	network.Partition([]proletariat.Address{"first"}, []proletariat.Address{"second"})
+	if err := second.Send("first", []byte("hello")); err != proletariat.ErrPartitioned {
+		t.Fatalf("should fail while partitioned. %v", err)
+	}
+
+	network.Heal()
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("should send after healing. %v", err)
+	}
+
+	if received := countReceived(first, 200*time.Millisecond); received != 1 {
+		t.Errorf("expected 1. found %d", received)
+	}
+}
+
+func TestSimulatedNetwork_DropAndDuplicate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createSimulatedPair(t, ctx, network)
+	defer closePair(t, cancel, first, second)
+
+	network.SetLink("second", "first", proletariat.Link{Drop: 1})
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	if received := countReceived(first, 200*time.Millisecond); received != 0 {
+		t.Errorf("expected all dropped. found %d", received)
+	}
+
+	network.SetLink("second", "first", proletariat.Link{Duplicate: 1})
+	for i := 0; i < 10; i++ {
+		if err := second.Send("first", []byte("hello")); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	if received := countReceived(first, 200*time.Millisecond); received != 20 {
+		t.Errorf("expected all duplicated. found %d", received)
+	}
+}
+
+func TestSimulatedNetwork_Latency(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createSimulatedPair(t, ctx, network)
+	defer closePair(t, cancel, first, second)
+
+	latency := 100 * time.Millisecond
+	network.SetDefaultLink(proletariat.Link{Latency: proletariat.FixedLatency(latency)})
+	start := time.Now()
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case <-first.Receive():
+		if elapsed := time.Since(start); elapsed < latency {
+			t.Errorf("received before latency. %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+}
+
+func TestSimulatedNetwork_Reproducible(t *testing.T) {
+	run := func() int {
+		ctx, cancel := context.WithCancel(context.TODO())
+		network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 7)
+		first, second := createSimulatedPair(t, ctx, network)
+		defer closePair(t, cancel, first, second)
+
+		network.SetDefaultLink(proletariat.Link{Drop: 0.5})
+		for i := 0; i < 50; i++ {
+			if err := second.Send("first", []byte("hello")); err != nil {
+				t.Fatalf("failed sending. %v", err)
+			}
+		}
+		return countReceived(first, 200*time.Millisecond)
+	}
+
+	one, other := run(), run()
+	if one != other {
+		t.Errorf("same seed should drop the same messages. %d != %d", one, other)
+	}
+
+	if one == 0 || one == 50 {
+		t.Errorf("expected some messages dropped. found %d", one)
+	}
+}
+
+func TestSimulatedNetwork_DuplicateLargeFrames(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	network := proletariat.NewSimulatedNetwork(proletariat.NewMemoryNetwork().NewTransport, 42)
+	first, second := createSimulatedPair(t, ctx, network)
+	defer closePair(t, cancel, first, second)
+
+	// Each frame is written in many chunks, which are not duplicated apart.
+	network.SetLink("second", "first", proletariat.Link{Duplicate: 1})
+	data := make([]byte, 64*1024)
+	for i := 0; i < 3; i++ {
+		if err := second.Send("first", data); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case d := <-first.Receive():
+			if d.Data.Len() != len(data) {
+				t.Errorf("expected %d bytes. found %d", len(data), d.Data.Len())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving %d", i)
+		}
+	}
+}
+
+func TestSimulatedNetwork_SlowDialerDoesNotBlockAccept(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	memory := proletariat.NewMemoryNetwork()
+	network := proletariat.NewSimulatedNetwork(memory.NewTransport, 42)
+	first, second := createSimulatedPair(t, ctx, network)
+	defer closePair(t, cancel, first, second)
+
+	// Connects without identifying itself.
+	raw, err := memory.NewTransport(ctx, "raw")
+	if err != nil {
+		t.Fatalf("failed raw: %v", err)
+	}
+	defer raw.Close()
+
+	conn, err := raw.Dial("first", time.Second)
+	if err != nil {
+		t.Fatalf("failed dialing. %v", err)
+	}
+	defer conn.Close()
+
+	if err = second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case d := <-first.Receive():
+		if d.Data.String() != "hello" {
+			t.Errorf("expected hello. found %s", d.Data.String())
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("took to long receiving")
+	}
+}
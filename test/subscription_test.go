@@ -0,0 +1,192 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"go.uber.org/goleak"
+	"testing"
+	"time"
+)
+
+func subscribe(t *testing.T, comm proletariat.Communication, filter proletariat.Filter) *proletariat.Subscription {
+	subscription, err := comm.Subscribe(filter, proletariat.ReceivePolicy{})
+	if err != nil {
+		t.Fatalf("failed subscribing. %v", err)
+	}
+	return subscription
+}
+
+func receiveFrom(t *testing.T, channel <-chan proletariat.Datagram, expected ...string) {
+	for _, content := range expected {
+		select {
+		case d := <-channel:
+			if d.Data.String() != content {
+				t.Errorf("expected %s. found %s", content, d.Data.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("took to long receiving %s", content)
+		}
+	}
+
+	select {
+	case d := <-channel:
+		t.Errorf("unexpected message %s", d.Data.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscription_FanOut(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	one, another := subscribe(t, first, proletariat.Filter{}), subscribe(t, first, proletariat.Filter{})
+	for _, content := range []string{"hello", "world"} {
+		if err := second.Send("first", []byte(content)); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	receiveFrom(t, one.Receive(), "hello", "world")
+	receiveFrom(t, another.Receive(), "hello", "world")
+	receiveFrom(t, first.Receive())
+}
+
+func TestSubscription_Filters(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	var transport proletariat.TransportFactory
+	first, second := createMemoryPair(t, ctx, func(configuration *proletariat.Configuration) {
+		transport = configuration.Transport
+	})
+
+	third, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   "third",
+		Ctx:       ctx,
+		Transport: transport,
+	})
+	if err != nil {
+		t.Fatalf("failed memory third: %v", err)
+	}
+	go third.Start()
+	defer func() {
+		closePair(t, cancel, first, second)
+		if err := third.Close(); err != nil {
+			t.Errorf("failed closing third. %v", err)
+		}
+	}()
+
+	fromThird := subscribe(t, first, proletariat.Filter{From: "third"})
+	withHeader := subscribe(t, first, proletariat.Filter{Headers: map[string][]byte{"topic": []byte("orders")}})
+	anyTopic := subscribe(t, first, proletariat.Filter{Headers: map[string][]byte{"topic": nil}})
+	withPrefix := subscribe(t, first, proletariat.Filter{Prefix: []byte("cmd:")})
+
+	sends := []struct {
+		from    proletariat.Communication
+		headers map[string][]byte
+		content string
+	}{
+		{from: third, content: "from third"},
+		{from: second, headers: map[string][]byte{"topic": []byte("orders")}, content: "order"},
+		{from: second, headers: map[string][]byte{"topic": []byte("users")}, content: "user"},
+		{from: second, content: "cmd:stop"},
+		{from: second, content: "unmatched"},
+	}
+	for _, send := range sends {
+		if err := send.from.SendWithHeaders("first", send.headers, []byte(send.content)); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+
+	receiveFrom(t, fromThird.Receive(), "from third")
+	receiveFrom(t, withHeader.Receive(), "order")
+	receiveFrom(t, anyTopic.Receive(), "order", "user")
+	receiveFrom(t, withPrefix.Receive(), "cmd:stop")
+	receiveFrom(t, first.Receive(), "unmatched")
+}
+
+func TestSubscription_Close(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+
+	subscription := subscribe(t, first, proletariat.Filter{})
+	if err := subscription.Close(); err != nil {
+		t.Fatalf("failed closing subscription. %v", err)
+	}
+
+	if _, ok := <-subscription.Receive(); ok {
+		t.Errorf("subscription channel should be closed")
+	}
+
+	// Without subscriptions, messages are published to the Receive channel.
+	if err := second.Send("first", []byte("hello")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "hello")
+
+	active := subscribe(t, first, proletariat.Filter{})
+	closePair(t, cancel, first, second)
+	if _, ok := <-active.Receive(); ok {
+		t.Errorf("subscription channel should be closed with the primitive")
+	}
+
+	if _, err := first.Subscribe(proletariat.Filter{}, proletariat.ReceivePolicy{}); err != proletariat.ErrAlreadyClosed {
+		t.Errorf("should fail subscribing after closed. %v", err)
+	}
+}
+
+func TestSubscription_CloseWhileFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	first, second := createMemoryPair(t, ctx, nil)
+	defer closePair(t, cancel, first, second)
+
+	subscription, err := first.Subscribe(proletariat.Filter{}, proletariat.ReceivePolicy{Capacity: 1})
+	if err != nil {
+		t.Fatalf("failed subscribing. %v", err)
+	}
+
+	// Nobody reads the subscription, so the second message waits for space.
+	for _, content := range []string{"hello", "world"} {
+		if err = second.Send("first", []byte(content)); err != nil {
+			t.Fatalf("failed sending. %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- subscription.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Errorf("failed closing subscription. %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long closing the subscription")
+	}
+
+	// The connection is read again after closing.
+	if err = second.Send("first", []byte("again")); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+	receiveFrom(t, first.Receive(), "again")
+}
@@ -45,3 +45,15 @@ func PrintStackTrace(t *testing.T) {
 func IsClosedError(err error) bool {
 	return strings.Contains(err.Error(), proletariat.ClosedConnection)
 }
+
+// Verify the condition until it holds or the duration expires.
+func Eventually(condition func() bool, duration time.Duration) bool {
+	deadline := time.Now().Add(duration)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
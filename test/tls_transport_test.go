@@ -0,0 +1,177 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Creates a self-signed certificate valid for the loopback address,
+// that can be used both as server and client certificate.
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key. %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proletariat"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating certificate. %v", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing certificate. %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func mutualTLSConfig(t *testing.T) *tls.Config {
+	certificate, pool := selfSignedCertificate(t)
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestTLSTransport_MissingConfiguration(t *testing.T) {
+	_, err := proletariat.NewTLSTransport(context.TODO(), "127.0.0.1:0", nil)
+	if err != proletariat.ErrMissingTLS {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestTLSTransport_BadAddress(t *testing.T) {
+	_, err := proletariat.NewTLSTransport(context.TODO(), "0.0.0.0:0", mutualTLSConfig(t))
+	if err != proletariat.ErrInvalidAddr {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestTLSTransport_RejectClientWithoutCertificate(t *testing.T) {
+	config := mutualTLSConfig(t)
+	server, err := proletariat.NewTLSTransport(context.TODO(), "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("failed creating server. %v", err)
+	}
+	defer server.Close()
+
+	client, err := proletariat.NewTLSTransport(context.TODO(), "127.0.0.1:0", &tls.Config{RootCAs: config.RootCAs})
+	if err != nil {
+		t.Fatalf("failed creating client. %v", err)
+	}
+	defer client.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		accepted <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := client.Dial(proletariat.Address(server.Addr().String()), time.Second)
+	if err == nil {
+		defer conn.Close()
+	}
+
+	select {
+	case err = <-accepted:
+		if err == nil {
+			t.Fatalf("server should reject client without certificate")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("took to long accepting")
+	}
+}
+
+func TestTLSCommunication_CreateAndSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	config := mutualTLSConfig(t)
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Timeout: time.Second,
+		Ctx:     ctx,
+		TLS:     config,
+	})
+	if err != nil {
+		t.Fatalf("failed tls one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Timeout: time.Second,
+		Ctx:     ctx,
+		TLS:     config,
+	})
+	if err != nil {
+		t.Fatalf("failed tls two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	content := []byte("Ola, Mundo!")
+	if err = second.Send(proletariat.Address(first.Addr().String()), content); err != nil {
+		t.Fatalf("failed sending. %v", err)
+	}
+
+	select {
+	case msg := <-first.Receive():
+		if string(content) != msg.Data.String() {
+			t.Errorf("failed. should be %s found %s", string(content), msg.Data.String())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("took to long receiving")
+	}
+
+	cancel()
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %s", err.Error())
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Transport that counts the dialed connections.
+type countingTransport struct {
+	proletariat.Transport
+	dials int64
+}
+
+func (c *countingTransport) Dial(address proletariat.Address, timeout time.Duration) (net.Conn, error) {
+	atomic.AddInt64(&c.dials, 1)
+	return c.Transport.Dial(address, timeout)
+}
+
+func TestTransport_FactoryError(t *testing.T) {
+	expected := errors.New("factory failed")
+	_, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     context.TODO(),
+		Transport: func(context.Context, proletariat.Address) (proletariat.Transport, error) {
+			return nil, expected
+		},
+	})
+	if err != expected {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestTransport_CustomFactory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	counting := &countingTransport{}
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+	})
+	if err != nil {
+		t.Fatalf("failed tcp one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address: "127.0.0.1:0",
+		Ctx:     ctx,
+		Transport: func(ctx context.Context, address proletariat.Address) (proletariat.Transport, error) {
+			tcp, err := proletariat.NewTCPTransport(ctx, address)
+			if err != nil {
+				return nil, err
+			}
+			counting.Transport = tcp
+			return counting, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed tcp two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	sendMultipleMessages(first, second, 10, t)
+	if atomic.LoadInt64(&counting.dials) == 0 {
+		t.Errorf("should dial using the custom transport")
+	}
+
+	cancel()
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %s", err.Error())
+	}
+}
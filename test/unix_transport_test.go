@@ -0,0 +1,130 @@
+// Copyright (C) 2020-2021 digital-comrades and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"github.com/digital-comrades/proletariat/pkg/proletariat"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func unixAddress(t *testing.T, name string) (proletariat.Address, string) {
+	path := filepath.Join(t.TempDir(), name)
+	return proletariat.Address(proletariat.UnixScheme + path), path
+}
+
+func TestUnixTransport_BadAddress(t *testing.T) {
+	for _, address := range []proletariat.Address{"/tmp/app.sock", "unix://app.sock", "unix://", "127.0.0.1:0"} {
+		_, err := proletariat.NewUnixTransport(context.TODO(), address)
+		if err != proletariat.ErrInvalidAddr {
+			t.Errorf("failed %s: %v", address, err)
+		}
+	}
+}
+
+func TestUnixTransport_NotSocketFile(t *testing.T) {
+	address, path := unixAddress(t, "app.sock")
+	if err := ioutil.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatalf("failed creating file. %v", err)
+	}
+
+	_, err := proletariat.NewUnixTransport(context.TODO(), address)
+	if err != proletariat.ErrInvalidAddr {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestUnixTransport_RemoveStaleSocket(t *testing.T) {
+	address, path := unixAddress(t, "app.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed creating stale socket. %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	transport, err := proletariat.NewUnixTransport(context.TODO(), address)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if transport.Addr().String() != string(address) {
+		t.Errorf("expected %s. found %s", address, transport.Addr().String())
+	}
+
+	if err = transport.Close(); err != nil {
+		t.Fatalf("failed closing. %v", err)
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file should be removed. %v", err)
+	}
+}
+
+func TestUnixTransport_AddressInUse(t *testing.T) {
+	address, _ := unixAddress(t, "app.sock")
+	transport, err := proletariat.NewUnixTransport(context.TODO(), address)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	defer transport.Close()
+
+	_, err = proletariat.NewUnixTransport(context.TODO(), address)
+	if err != proletariat.ErrAddrInUse {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestUnixCommunication_SendMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	firstAddr, _ := unixAddress(t, "first.sock")
+	secondAddr, _ := unixAddress(t, "second.sock")
+	first, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   firstAddr,
+		Ctx:       ctx,
+		Transport: proletariat.NewUnixTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed unix one: %v", err)
+	}
+
+	second, err := proletariat.NewCommunication(proletariat.Configuration{
+		Address:   secondAddr,
+		Ctx:       ctx,
+		PoolSize:  10,
+		Transport: proletariat.NewUnixTransport,
+	})
+	if err != nil {
+		t.Fatalf("failed unix two: %v", err)
+	}
+
+	go first.Start()
+	go second.Start()
+
+	sendMultipleMessages(first, second, 128, t)
+	cancel()
+
+	if err := first.Close(); err != nil {
+		t.Errorf("failed closing first. %s", err.Error())
+	}
+
+	if err := second.Close(); err != nil {
+		t.Errorf("failed closing second. %s", err.Error())
+	}
+}